@@ -0,0 +1,75 @@
+// bits.go - Reading of the bit-packed fields of metadata blocks.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package flac
+
+import "fmt"
+
+// bitReader reads the fields of a block that FLAC packs as a big-endian bit
+// string, most significant bit first, such as STREAMINFO and the block
+// header. Fields need not be byte aligned. The little-endian lengths of
+// Vorbis comments are read byte-wise with readField and binary.LittleEndian
+// instead.
+//
+// The first read past the end of the data records an error in err; later
+// reads return zero values, so a run of fields is checked once at the end.
+type bitReader struct {
+	b   []byte
+	off uint // bits read so far
+	err error
+}
+
+// read returns the next n bits, at most 64, as an unsigned integer. name is
+// the field named in the error if fewer than n bits are left.
+func (br *bitReader) read(n uint, name string) uint64 {
+	if br.err != nil {
+		return 0
+	}
+	if left := uint(len(br.b))*8 - br.off; n > left {
+		br.err = fmt.Errorf("FATAL: error reading %s field. Expected %d bit(s), got %d.", name, n, left)
+		return 0
+	}
+
+	var v uint64
+	for n > 0 {
+		avail := 8 - br.off%8 // bits left in the current byte
+		take := avail
+		if n < take {
+			take = n
+		}
+		c := br.b[br.off/8] >> (avail - take) & (0xFF >> (8 - take))
+		v = v<<take | uint64(c)
+		br.off += take
+		n -= take
+	}
+	return v
+}
+
+// bytes returns the next n whole bytes, which must start on a byte boundary.
+// The slice shares the reader's data.
+func (br *bitReader) bytes(n int, name string) []byte {
+	if br.err != nil {
+		return nil
+	}
+	if br.off%8 != 0 {
+		br.err = fmt.Errorf("FATAL: %s field is not byte aligned.", name)
+		return nil
+	}
+	start := int(br.off / 8)
+	if left := len(br.b) - start; n > left {
+		br.err = fmt.Errorf("FATAL: error reading %s field. Expected %d byte(s), got %d.", name, n, left)
+		return nil
+	}
+	br.off += uint(n) * 8
+	return br.b[start : start+n]
+}
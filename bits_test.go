@@ -0,0 +1,64 @@
+package flac
+
+import (
+	"encoding/binary"
+	. "launchpad.net/gocheck"
+	"math/rand"
+)
+
+func (s *S) TestBitReader(c *C) {
+	br := &bitReader{b: []byte{0xA5, 0x3C, 0xFF, 0x01}}
+	c.Check(br.read(1, "a"), Equals, uint64(1))
+	c.Check(br.read(3, "b"), Equals, uint64(0x2))
+	c.Check(br.read(12, "c"), Equals, uint64(0x53C))
+	c.Check(br.bytes(1, "d"), DeepEquals, []byte{0xFF})
+	c.Check(br.read(8, "e"), Equals, uint64(0x01))
+	c.Check(br.err, IsNil)
+
+	c.Check(br.read(1, "f"), Equals, uint64(0))
+	c.Check(br.err, ErrorMatches, "FATAL: error reading f field. Expected 1 bit\\(s\\), got 0.")
+	// Later reads keep the first error.
+	br.read(1, "g")
+	c.Check(br.err, ErrorMatches, ".*reading f field.*")
+
+	br = &bitReader{b: make([]byte, 8)}
+	br.read(4, "a")
+	br.bytes(1, "b")
+	c.Check(br.err, ErrorMatches, "FATAL: b field is not byte aligned.")
+
+	br = &bitReader{b: []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 1}}
+	c.Check(br.read(64, "a"), Equals, uint64(1<<63))
+	c.Check(br.read(8, "b"), Equals, uint64(1))
+}
+
+// maskStreaminfo decodes a STREAMINFO block with the masks and shifts that
+// StreaminfoBlock.Parse used before bitReader.
+func maskStreaminfo(block []byte) StreaminfoBlock {
+	var sib StreaminfoBlock
+	sib.MinBlockSize = binary.BigEndian.Uint16(block[0:2])
+	bits := binary.BigEndian.Uint64(block[2:10])
+	sib.MaxBlockSize = uint16((0xFFFF000000000000 & bits) >> 48)
+	sib.MinFrameSize = uint32((0xFFFFFF000000 & bits) >> 24)
+	sib.MaxFrameSize = uint32(0xFFFFFF & bits)
+	bits = binary.BigEndian.Uint64(block[10:18])
+	sib.SampleRate = uint32((0xFFFFF00000000000 & bits) >> 44)
+	sib.Channels = uint8((0xE0000000000&bits)>>41) + 1
+	sib.BitsPerSample = uint8((0x1F000000000&bits)>>36) + 1
+	sib.TotalSamples = bits & 0xFFFFFFFFF
+	copy(sib.MD5[:], block[18:34])
+	sib.MD5Signature = sib.MD5.String()
+	return sib
+}
+
+func (s *S) TestStreaminfoParseMatchesMasks(c *C) {
+	rnd := rand.New(rand.NewSource(1))
+	block := make([]byte, 34)
+	for i := 0; i < 1000; i++ {
+		rnd.Read(block)
+		sib := new(StreaminfoBlock)
+		// Random blocks often fail the checks in Parse, but the fields
+		// are decoded first either way.
+		sib.Parse(block)
+		c.Assert(*sib, Equals, maskStreaminfo(block), Commentf("block % x", block))
+	}
+}
@@ -0,0 +1,137 @@
+// diff.go - The diff subcommand of flacmeta.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	flac "github.com/justinruggles/goflac-meta"
+)
+
+// runDiff prints the differences between the metadata of files a and b and
+// returns the exit status: 0 if they are equal, 1 if they differ and 2 if
+// either could not be read, as diff(1) does.
+func runDiff(a, b string) int {
+	ma, err := readFile(a)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", a, err)
+		return 2
+	}
+	mb, err := readFile(b)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", b, err)
+		return 2
+	}
+	if ma.Equal(mb) {
+		return 0
+	}
+	if !*silent {
+		fmt.Printf("--- %s\n+++ %s\n", a, b)
+		diffStreaminfo(ma.Streaminfo.Data, mb.Streaminfo.Data)
+		diffComments(ma.VorbisComment.Data, mb.VorbisComment.Data)
+		if !reflect.DeepEqual(ma.Seektable.Data, mb.Seektable.Data) {
+			fmt.Printf("~ SEEKTABLE: %d seek point(s) -> %d seek point(s)\n", len(ma.Seektable.Data), len(mb.Seektable.Data))
+		}
+		diffPictures(ma.Pictures, mb.Pictures)
+	}
+	return 1
+}
+
+// diffStreaminfo prints each STREAMINFO field that differs between a and b.
+func diffStreaminfo(a, b *flac.StreaminfoBlock) {
+	if a == nil || b == nil {
+		return
+	}
+	fields := []struct {
+		name string
+		a, b interface{}
+	}{
+		{"minimum blocksize", a.MinBlockSize, b.MinBlockSize},
+		{"maximum blocksize", a.MaxBlockSize, b.MaxBlockSize},
+		{"minimum framesize", a.MinFrameSize, b.MinFrameSize},
+		{"maximum framesize", a.MaxFrameSize, b.MaxFrameSize},
+		{"sample_rate", a.SampleRate, b.SampleRate},
+		{"channels", a.Channels, b.Channels},
+		{"bits-per-sample", a.BitsPerSample, b.BitsPerSample},
+		{"total samples", a.TotalSamples, b.TotalSamples},
+		{"MD5 signature", a.MD5, b.MD5},
+	}
+	for _, f := range fields {
+		if f.a != f.b {
+			fmt.Printf("~ STREAMINFO %s: %v -> %v\n", f.name, f.a, f.b)
+		}
+	}
+}
+
+// diffComments prints the comments removed from a, added in b and changed
+// between them, by field name. The order of different fields is ignored.
+func diffComments(a, b *flac.VorbisCommentBlock) {
+	if a == nil {
+		a = new(flac.VorbisCommentBlock)
+	}
+	if b == nil {
+		b = new(flac.VorbisCommentBlock)
+	}
+	if a.Vendor != b.Vendor {
+		fmt.Printf("~ vendor string: %s -> %s\n", a.Vendor, b.Vendor)
+	}
+
+	ta, tb := a.Tags(), b.Tags()
+	var keys []string
+	for k := range ta {
+		keys = append(keys, k)
+	}
+	for k := range tb {
+		if _, ok := ta[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		va, inA := ta[k]
+		vb, inB := tb[k]
+		switch {
+		case !inB:
+			for _, v := range va {
+				fmt.Printf("- %s=%s\n", k, v)
+			}
+		case !inA:
+			for _, v := range vb {
+				fmt.Printf("+ %s=%s\n", k, v)
+			}
+		case !reflect.DeepEqual(va, vb):
+			fmt.Printf("~ %s: %s -> %s\n", k, strings.Join(va, "; "), strings.Join(vb, "; "))
+		}
+	}
+}
+
+// diffPictures prints the pictures that differ between a and b, in file
+// order.
+func diffPictures(a, b []*flac.Picture) {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(b):
+			fmt.Printf("- PICTURE[%d]: %s\n", i, a[i].Data.PictureType)
+		case i >= len(a):
+			fmt.Printf("+ PICTURE[%d]: %s\n", i, b[i].Data.PictureType)
+		case !reflect.DeepEqual(a[i].Data, b[i].Data):
+			fmt.Printf("~ PICTURE[%d]: %s -> %s\n", i, a[i].Data.PictureType, b[i].Data.PictureType)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// edit.go - Operations of flacmeta that change a file.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	flac "github.com/justinruggles/goflac-meta"
+)
+
+// writeVorbisComment replaces the VORBIS_COMMENT block of the named file
+// with vcb. The block is written in place when the padding after it has
+// room; otherwise the file is rewritten to a temporary file in the same
+// directory, which then replaces it.
+func writeVorbisComment(name string, vcb *flac.VorbisCommentBlock) error {
+	if name == "-" {
+		return fmt.Errorf("cannot edit standard input")
+	}
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = flac.WriteVorbisCommentInPlace(f, vcb)
+	if !errors.Is(err, flac.ErrNoRoom) {
+		return err
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := flac.RewriteVorbisComment(f, tmp, vcb); err != nil {
+		tmp.Close()
+		return err
+	}
+	if fi, err := f.Stat(); err == nil {
+		tmp.Chmod(fi.Mode())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// addReplayGainPlaceholders adds placeholder ReplayGain comments to the
+// named file, if it lacks them; see
+// flac.VorbisCommentBlock.AddReplayGainPlaceholders.
+func addReplayGainPlaceholders(name string, meta *flac.Metadata) error {
+	vcb := meta.PrimaryComments()
+	if vcb == nil {
+		vcb = &flac.VorbisCommentBlock{Vendor: "goflac-meta"}
+	}
+	if !vcb.AddReplayGainPlaceholders() {
+		return nil
+	}
+	return writeVorbisComment(name, vcb)
+}
@@ -0,0 +1,157 @@
+// format.go - Machine-readable output formats of flacmeta.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"strings"
+
+	flac "github.com/justinruggles/goflac-meta"
+)
+
+// jsonFile is the JSON form of the selected blocks of one file.
+type jsonFile struct {
+	File   string      `json:"file"`
+	Blocks []jsonBlock `json:"blocks"`
+}
+
+// jsonBlock is the JSON form of one metadata block. Data is the decoded
+// block, or the raw bytes of a block of unknown type.
+type jsonBlock struct {
+	Number int         `json:"number"`
+	Type   string      `json:"type"`
+	Last   bool        `json:"is_last"`
+	Length uint32      `json:"length"`
+	Data   interface{} `json:"data"`
+}
+
+// blockData returns the decoded data of block b of meta.
+func blockData(meta *flac.Metadata, b *flac.Block) interface{} {
+	switch b.Header.Type {
+	case flac.MetadataStreaminfo:
+		return meta.Streaminfo.Data
+	case flac.MetadataApplication:
+		return meta.Application.Data
+	case flac.MetadataSeektable:
+		return meta.Seektable.Data
+	case flac.MetadataVorbisComment:
+		return meta.VorbisCommentOf(b.Header)
+	case flac.MetadataCuesheet:
+		return meta.Cuesheet.Data
+	case flac.MetadataPicture:
+		for _, pic := range meta.Pictures {
+			if pic.Header == b.Header {
+				return pic.Data
+			}
+		}
+	case flac.MetadataPadding:
+		if b.Header == meta.Padding.Header {
+			return meta.Padding.Data
+		}
+		return &flac.PaddingBlock{Length: b.Header.Length}
+	}
+	return b.Raw
+}
+
+// jsonMetadata returns the JSON form of the selected blocks of meta, read
+// from the named file.
+func jsonMetadata(name string, meta *flac.Metadata) jsonFile {
+	jf := jsonFile{File: name, Blocks: []jsonBlock{}}
+	for i, b := range meta.Blocks {
+		if !selected(i, b.Header) {
+			continue
+		}
+		jf.Blocks = append(jf.Blocks, jsonBlock{
+			Number: i,
+			Type:   b.Header.Type.String(),
+			Last:   b.Header.Last,
+			Length: b.Header.Length,
+			Data:   blockData(meta, b),
+		})
+	}
+	return jf
+}
+
+// writeCSV writes a file, key, value row for each field of the selected
+// blocks of meta. Vorbis comments are keyed by their field name; the fields
+// of other blocks by the block type and field name, as in
+// "STREAMINFO.sample_rate".
+func writeCSV(w *csv.Writer, name string, meta *flac.Metadata) error {
+	for i, b := range meta.Blocks {
+		if !selected(i, b.Header) {
+			continue
+		}
+		for _, kv := range blockFields(meta, b) {
+			if err := w.Write([]string{name, kv[0], kv[1]}); err != nil {
+				return err
+			}
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// blockFields returns the key and value of each field of block b of meta.
+func blockFields(meta *flac.Metadata, b *flac.Block) [][2]string {
+	t := b.Header.Type.String() + "."
+	u := func(v uint64) string { return strconv.FormatUint(v, 10) }
+	switch data := blockData(meta, b).(type) {
+	case *flac.StreaminfoBlock:
+		return [][2]string{
+			{t + "min_blocksize", u(uint64(data.MinBlockSize))},
+			{t + "max_blocksize", u(uint64(data.MaxBlockSize))},
+			{t + "min_framesize", u(uint64(data.MinFrameSize))},
+			{t + "max_framesize", u(uint64(data.MaxFrameSize))},
+			{t + "sample_rate", u(uint64(data.SampleRate))},
+			{t + "channels", u(uint64(data.Channels))},
+			{t + "bits_per_sample", u(uint64(data.BitsPerSample))},
+			{t + "total_samples", u(data.TotalSamples)},
+			{t + "md5", data.MD5.String()},
+			{t + "has_md5", strconv.FormatBool(data.HasMD5())},
+		}
+	case *flac.ApplicationBlock:
+		return [][2]string{
+			{t + "id", fmt.Sprintf("%08x", data.Id)},
+			{t + "data_length", strconv.Itoa(len(data.Data))},
+		}
+	case []*flac.SeekpointBlock:
+		return [][2]string{{t + "seek_points", strconv.Itoa(len(data))}}
+	case *flac.VorbisCommentBlock:
+		fields := [][2]string{{t + "vendor", data.Vendor}}
+		for _, comment := range data.Comments {
+			k, v, _ := strings.Cut(comment, "=")
+			fields = append(fields, [2]string{k, v})
+		}
+		return fields
+	case *flac.CuesheetBlock:
+		return [][2]string{
+			{t + "media_catalog_number", data.MediaCatalogNumber},
+			{t + "lead_in", u(data.LeadinSamples)},
+			{t + "is_cd", strconv.FormatBool(data.IsCompactDisc)},
+			{t + "tracks", u(uint64(data.TotalTracks))},
+		}
+	case *flac.PictureBlock:
+		return [][2]string{
+			{t + "type", u(uint64(data.PictureTypeId))},
+			{t + "mime_type", data.MimeType},
+			{t + "description", data.PictureDescription},
+			{t + "width", u(uint64(data.Width))},
+			{t + "height", u(uint64(data.Height))},
+			{t + "data_length", u(uint64(data.Length))},
+		}
+	}
+	return [][2]string{{t + "length", u(uint64(b.Header.Length))}}
+}
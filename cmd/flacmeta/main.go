@@ -0,0 +1,421 @@
+// main.go - Command flacmeta lists the metadata of a FLAC file.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+// Command flacmeta prints the metadata blocks of a FLAC file.
+package main
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	flac "github.com/justinruggles/goflac-meta"
+)
+
+// fileList collects the values of a repeatable flag.
+type fileList []string
+
+func (fl *fileList) String() string { return strings.Join(*fl, ",") }
+
+func (fl *fileList) Set(v string) error {
+	*fl = append(*fl, v)
+	return nil
+}
+
+// intSet collects the comma-separated values of a repeatable integer flag.
+type intSet map[int]bool
+
+func (is intSet) String() string {
+	var s []string
+	for i := range is {
+		s = append(s, strconv.Itoa(i))
+	}
+	return strings.Join(s, ",")
+}
+
+func (is intSet) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return err
+		}
+		is[i] = true
+	}
+	return nil
+}
+
+// typeSet collects the comma-separated block type names of a repeatable flag.
+type typeSet map[string]bool
+
+func (ts typeSet) String() string {
+	var s []string
+	for t := range ts {
+		s = append(s, t)
+	}
+	return strings.Join(s, ",")
+}
+
+func (ts typeSet) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		t := strings.ToUpper(strings.TrimSpace(f))
+		switch t {
+		case "STREAMINFO", "PADDING", "APPLICATION", "SEEKTABLE",
+			"VORBIS_COMMENT", "CUESHEET", "PICTURE", "UNKNOWN":
+			ts[t] = true
+		default:
+			return fmt.Errorf("unknown block type %q", f)
+		}
+	}
+	return nil
+}
+
+var (
+	flacFiles        fileList
+	blockNumbers     = intSet{}
+	blockTypes       = typeSet{}
+	exceptBlockTypes = typeSet{}
+
+	exportPictureTo = flag.String("export-picture-to", "", "write the image data of a PICTURE block to `file`, or - for standard output")
+	pictureType     = flag.Int("picture-type", -1, "export the first picture of this APIC `type` (3 = front cover) instead of the first picture")
+	force           = flag.Bool("force", false, "overwrite existing files")
+	showVendorOnly  = flag.Bool("show-vendor-only", false, "print only the Vorbis comment vendor string, or an empty line if there is none")
+	showDuration    = flag.Bool("show-duration", false, "print only the duration of the audio as HH:MM:SS.mmm, or unknown")
+	silent          = flag.Bool("silent", false, "print nothing; only set the exit status")
+	verbose         = flag.Bool("verbose", false, "print extra detail; implies --hexdump-unknown")
+	hexdumpUnknown  = flag.Bool("hexdump-unknown", false, "print a hex and ASCII dump of APPLICATION data and unknown metadata blocks")
+	addReplayGain   = flag.Bool("add-replaygain-placeholder", false, "add placeholder ReplayGain comments to files that lack them, for an analyzer to fill in")
+	outputFormat    = flag.String("output-format", "tree", "listing `format`: tree, json, or csv with a file, key, value row per field")
+)
+
+func init() {
+	flag.Var(&flacFiles, "f", "FLAC file to read, or - for standard input; may be repeated")
+	flag.Var(blockNumbers, "block-number", "comma-separated `list` of metadata block numbers to show")
+	flag.Var(blockTypes, "block-type", "comma-separated `list` of block types to show, e.g. VORBIS_COMMENT,PICTURE")
+	flag.Var(exceptBlockTypes, "except-block-type", "comma-separated `list` of block types not to show")
+}
+
+// selected reports whether block number i, with header mbh, passes the
+// block number and block type filters.
+func selected(i int, mbh *flac.MetadataBlockHeader) bool {
+	if len(blockNumbers) > 0 && !blockNumbers[i] {
+		return false
+	}
+	t := mbh.Type.String()
+	if len(blockTypes) > 0 && !blockTypes[t] {
+		return false
+	}
+	return !exceptBlockTypes[t]
+}
+
+func main() {
+	flag.Parse()
+	switch flag.Arg(0) {
+	case "diff":
+		if flag.NArg() != 3 {
+			fmt.Fprintln(os.Stderr, "usage: flacmeta diff a.flac b.flac")
+			os.Exit(2)
+		}
+		os.Exit(runDiff(flag.Arg(1), flag.Arg(2)))
+	case "export-tags":
+		if flag.NArg() != 2 {
+			fmt.Fprintln(os.Stderr, "usage: flacmeta export-tags file.flac")
+			os.Exit(2)
+		}
+		os.Exit(runExportTags(flag.Arg(1)))
+	case "import-tags":
+		os.Exit(runImportTags(flag.Args()[1:]))
+	}
+	files := append(flacFiles, flag.Args()...)
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: flacmeta [-f file.flac]... [file.flac...]")
+		fmt.Fprintln(os.Stderr, "       flacmeta diff a.flac b.flac")
+		fmt.Fprintln(os.Stderr, "       flacmeta export-tags file.flac")
+		fmt.Fprintln(os.Stderr, "       flacmeta import-tags --from=tags.txt file.flac")
+		os.Exit(2)
+	}
+	switch *outputFormat {
+	case "tree", "json", "csv":
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q; use tree, json or csv\n", *outputFormat)
+		os.Exit(2)
+	}
+
+	failed := false
+	jsonFiles := []jsonFile{}
+	csvWriter := csv.NewWriter(os.Stdout)
+	for _, name := range files {
+		p := &printer{}
+		if len(files) > 1 {
+			p.prefix = name + ":"
+		}
+		meta, err := readFile(name)
+		if err == nil {
+			switch {
+			case *addReplayGain:
+				err = addReplayGainPlaceholders(name, meta)
+			case *silent:
+			case *exportPictureTo != "":
+				err = exportPicture(meta, *exportPictureTo)
+			case *showDuration:
+				d, ok := meta.Streaminfo.Data.Duration()
+				if ok {
+					p.printf("%s\n", flac.FormatTimestamp(d))
+				} else {
+					p.printf("unknown\n")
+				}
+			case *showVendorOnly:
+				vendor := ""
+				if meta.VorbisComment.IsPopulated {
+					vendor = meta.VorbisComment.Data.Vendor
+				}
+				p.printf("%s\n", vendor)
+			case *outputFormat == "json":
+				jsonFiles = append(jsonFiles, jsonMetadata(name, meta))
+			case *outputFormat == "csv":
+				err = writeCSV(csvWriter, name, meta)
+			default:
+				printMetadata(meta, p)
+			}
+		}
+		if err != nil {
+			if !*silent {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+			}
+			failed = true
+		}
+	}
+	if *outputFormat == "json" && !*silent && *exportPictureTo == "" && !*showDuration && !*showVendorOnly {
+		b, err := json.MarshalIndent(jsonFiles, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s\n", b)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// readFile reads the metadata of the named file, or of standard input if
+// name is "-".
+func readFile(name string) (*flac.Metadata, error) {
+	f := os.Stdin
+	if name != "-" {
+		var err error
+		f, err = os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+	}
+	return flac.ParseMetadata(f)
+}
+
+// pictureExtensions maps common picture MIME types to a file extension.
+var pictureExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/jpg":  ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/bmp":  ".bmp",
+	"image/tiff": ".tif",
+	"image/webp": ".webp",
+}
+
+// exportPicture writes the image data of the selected picture to path. If
+// path has no extension, one is chosen from the picture's MIME type.
+func exportPicture(meta *flac.Metadata, path string) error {
+	var pb *flac.PictureBlock
+	if *pictureType < 0 {
+		if len(meta.Pictures) > 0 {
+			pb = meta.Pictures[0].Data
+		}
+	} else {
+		pb, _ = meta.Picture(uint32(*pictureType))
+	}
+	if pb == nil {
+		return fmt.Errorf("no matching PICTURE block")
+	}
+	if pb.MimeType == "-->" {
+		return fmt.Errorf("picture is a link to %s, not image data", pb.PictureBlob)
+	}
+
+	if path == "-" {
+		_, err := os.Stdout.Write(pb.PictureBlob)
+		return err
+	}
+	if filepath.Ext(path) == "" {
+		path += pictureExtensions[strings.ToLower(pb.MimeType)]
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, mode, 0666)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%s already exists; use --force to overwrite it", path)
+		}
+		return err
+	}
+	if _, err := f.Write(pb.PictureBlob); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// printer writes listing lines, each prefixed with the file name when
+// several files are listed.
+type printer struct {
+	prefix string
+}
+
+func (p *printer) printf(format string, args ...interface{}) {
+	fmt.Print(p.prefix)
+	fmt.Printf(format, args...)
+}
+
+// printMetadata writes a metaflac-like listing of the selected blocks, in
+// file order.
+func printMetadata(meta *flac.Metadata, p *printer) {
+	if meta.ID3v2Length > 0 {
+		p.printf("WARNING: file starts with a non-standard %d byte ID3v2 tag\n", meta.ID3v2Length)
+	}
+	for _, vc := range meta.VorbisComments {
+		for _, comment := range vc.Data.SuspiciousTags() {
+			p.printf("WARNING: comment has control characters: %q\n", comment)
+		}
+	}
+	for i, b := range meta.Blocks {
+		if !selected(i, b.Header) {
+			continue
+		}
+		p.printf("METADATA block #%d\n", i)
+		p.printIndented(b.Header.String())
+		printBlock(meta, b, p)
+		if raw, ok := blockData(meta, b).([]byte); ok {
+			p.printHexdump(raw)
+		}
+	}
+}
+
+// printBlock writes the decoded fields of block b of meta.
+func printBlock(meta *flac.Metadata, b *flac.Block, p *printer) {
+	mbh := b.Header
+	switch mbh.Type {
+	case flac.MetadataStreaminfo:
+		p.printIndented(meta.Streaminfo.Data.String())
+		if d, ok := meta.Streaminfo.Data.Duration(); ok {
+			p.printf("  duration: %s\n", d)
+		} else {
+			p.printf("  duration: unknown\n")
+		}
+
+	case flac.MetadataApplication:
+		p.printf("  application ID: %08x\n", meta.Application.Data.Id)
+		if id, ok := meta.Application.Data.IdString(); ok {
+			p.printf("  application name: %s\n", id)
+		}
+		p.printf("  data length: %d bytes\n", len(meta.Application.Data.Data))
+		p.printHexdump(meta.Application.Data.Data)
+
+	case flac.MetadataSeektable:
+		p.printf("  seek points: %d\n", meta.Seektable.Header.SeekPoints)
+		for i, spb := range meta.Seektable.Data {
+			if spb.IsPlaceholder() {
+				p.printf("    point %d: PLACEHOLDER\n", i)
+				continue
+			}
+			p.printf("    point %d: sample_number=%d, stream_offset=%d, frame_samples=%d\n",
+				i, spb.SampleNumber, spb.Offset, spb.FrameSamples)
+		}
+
+	case flac.MetadataVorbisComment:
+		vcb := meta.VorbisCommentOf(mbh)
+		p.printf("  vendor string: %s\n", vcb.Vendor)
+		p.printf("  comments: %d\n", vcb.TotalComments)
+		for i, comment := range vcb.Comments {
+			p.printf("    comment[%d]: %s\n", i, comment)
+		}
+
+	case flac.MetadataCuesheet:
+		cb := meta.Cuesheet.Data
+		p.printf("  media catalog number: %s\n", cb.MediaCatalogNumber)
+		p.printf("  lead-in: %d\n", cb.LeadinSamples)
+		p.printf("  is CD: %t\n", cb.IsCompactDisc)
+		p.printf("  number of tracks: %d\n", cb.TotalTracks)
+		for i, ctb := range cb.CuesheetTracks {
+			p.printf("    track[%d]\n", i)
+			p.printf("      offset: %d\n", ctb.TrackOffset)
+			p.printf("      number: %d\n", ctb.TrackNumber)
+			p.printf("      ISRC: %s\n", ctb.TrackISRC)
+			p.printf("      type: %d\n", ctb.TrackType)
+			p.printf("      pre-emphasis: %t\n", ctb.PreEmphasis)
+			p.printf("      number of index points: %d\n", ctb.IndexPoints)
+			for j, cti := range ctb.CuesheetTrackIndexes {
+				p.printf("        index[%d]\n", j)
+				p.printf("          offset: %d\n", cti.SampleOffset)
+				p.printf("          number: %d\n", cti.IndexPoint)
+			}
+		}
+
+	case flac.MetadataPicture:
+		for _, pic := range meta.Pictures {
+			if pic.Header != mbh {
+				continue
+			}
+			pb := pic.Data
+			p.printf("  type: %d (%s)\n", pb.PictureTypeId, pb.PictureType)
+			p.printf("  MIME type: %s\n", pb.MimeType)
+			p.printf("  description: %s\n", pb.PictureDescription)
+			p.printf("  width: %d\n", pb.Width)
+			p.printf("  height: %d\n", pb.Height)
+			p.printf("  depth: %d\n", pb.ColorDepth)
+			p.printf("  colors: %d\n", pb.NumColors)
+			p.printf("  data length: %d\n", pb.Length)
+		}
+
+	case flac.MetadataPadding:
+		// There may be several PADDING blocks; meta.Padding is only the
+		// first, so each is checked from its own data.
+		pb := new(flac.PaddingBlock)
+		pb.Parse(b.Raw)
+		if !pb.IsZero {
+			p.printf("  WARNING: padding contains non-zero bytes\n")
+		}
+	}
+}
+
+// printHexdump writes a hexdump -C style dump of b, the data of a block not
+// decoded field by field, if --hexdump-unknown or --verbose was given.
+func (p *printer) printHexdump(b []byte) {
+	if (*hexdumpUnknown || *verbose) && len(b) > 0 {
+		p.printIndented(strings.TrimSuffix(hex.Dump(b), "\n"))
+	}
+}
+
+// printIndented writes each line of s indented by two spaces.
+func (p *printer) printIndented(s string) {
+	for _, line := range strings.Split(s, "\n") {
+		p.printf("  %s\n", line)
+	}
+}
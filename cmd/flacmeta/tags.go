@@ -0,0 +1,172 @@
+// tags.go - The export-tags and import-tags subcommands of flacmeta.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	flac "github.com/justinruggles/goflac-meta"
+)
+
+// runExportTags prints the Vorbis comments of the named file as
+// metaflac --export-tags-to=- does, and returns the exit status.
+func runExportTags(name string) int {
+	meta, err := readFile(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		return 1
+	}
+	vcb := meta.PrimaryComments()
+	if vcb == nil {
+		return 0
+	}
+	if err := writeTags(os.Stdout, vcb.Comments); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// tagEscaper escapes the characters of a comment that would end its line.
+var tagEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// writeTags writes each comment as stored, NAME=value with the case of the
+// name kept, followed by a newline. So that every comment is one line for
+// readTags, a newline or carriage return in a value is written as \n or \r,
+// and a backslash as \\.
+func writeTags(w io.Writer, comments []string) error {
+	bw := bufio.NewWriter(w)
+	for _, comment := range comments {
+		tagEscaper.WriteString(bw, comment)
+		bw.WriteByte('\n')
+	}
+	return bw.Flush()
+}
+
+// runImportTags runs "import-tags --from=tags.txt file.flac": it replaces
+// the Vorbis comments of the file with those read by readTags, keeping the
+// vendor string, and returns the exit status. --from=- reads standard
+// input. Unlike metaflac --import-tags-from, which adds to the existing
+// comments, no separate --remove-all-tags is needed.
+func runImportTags(args []string) int {
+	fs := flag.NewFlagSet("import-tags", flag.ExitOnError)
+	from := fs.String("from", "", "`file` of NAME=value lines to import, or - for standard input")
+	fs.Parse(args)
+	if *from == "" || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: flacmeta import-tags --from=tags.txt file.flac")
+		return 2
+	}
+	name := fs.Arg(0)
+
+	r := os.Stdin
+	if *from != "-" {
+		f, err := os.Open(*from)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		r = f
+	}
+	comments, err := readTags(r)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *from, err)
+		return 1
+	}
+
+	meta, err := readFile(name)
+	if err == nil {
+		vcb := &flac.VorbisCommentBlock{Vendor: "goflac-meta"}
+		if old := meta.PrimaryComments(); old != nil {
+			vcb.Vendor = old.Vendor
+		}
+		vcb.Comments = comments
+		vcb.TotalComments = uint32(len(comments))
+		err = writeVorbisComment(name, vcb)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+// readTags reads comments in the format of metaflac --export-tags-to: one
+// NAME=value per line, a field name appearing once per value. Blank lines
+// and lines starting with '#' are skipped, and a trailing carriage return is
+// dropped. The escapes of writeTags are undone; a backslash before any other
+// character is kept. A field name must be printable ASCII other than '='.
+func readTags(r io.Reader) ([]string, error) {
+	comments := []string{}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, flac.MetadataBlockMaxLength)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = unescapeTag(line)
+		key, _, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: malformed comment %q; expected NAME=value", n, line)
+		}
+		if !validFieldName(key) {
+			return nil, fmt.Errorf("line %d: invalid field name %q", n, key)
+		}
+		comments = append(comments, line)
+	}
+	return comments, sc.Err()
+}
+
+// tagUnescapes maps the character after a backslash in a writeTags escape to
+// the character it stands for.
+var tagUnescapes = map[byte]byte{'n': '\n', 'r': '\r', '\\': '\\'}
+
+// unescapeTag undoes the escapes of writeTags in line.
+func unescapeTag(line string) string {
+	if !strings.Contains(line, `\`) {
+		return line
+	}
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' && i+1 < len(line) {
+			if c, ok := tagUnescapes[line[i+1]]; ok {
+				b.WriteByte(c)
+				i++
+				continue
+			}
+		}
+		b.WriteByte(line[i])
+	}
+	return b.String()
+}
+
+// validFieldName reports whether key is a non-empty Vorbis comment field
+// name: ASCII 0x20 through 0x7D, excluding '='.
+func validFieldName(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7D || key[i] == '=' {
+			return false
+		}
+	}
+	return true
+}
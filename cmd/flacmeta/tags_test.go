@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	. "launchpad.net/gocheck"
+	"strings"
+	"testing"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type S struct{}
+
+var _ = Suite(&S{})
+
+func (s *S) TestTagsRoundTrip(c *C) {
+	comments := []string{
+		"TITLE=a",
+		"LYRICS=line one\nline two\n",
+		"COMMENT=dos\r\nline",
+		`PATH=C:\music\n.flac`,
+		"EMPTY=",
+	}
+	var buf bytes.Buffer
+	c.Assert(writeTags(&buf, comments), IsNil)
+	c.Check(strings.Count(buf.String(), "\n"), Equals, len(comments))
+
+	got, err := readTags(&buf)
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, comments)
+}
+
+func (s *S) TestReadTags(c *C) {
+	got, err := readTags(strings.NewReader("# exported\r\nTITLE=a\r\n\r\nPATH=C:\\music\\a.flac\n"))
+	c.Assert(err, IsNil)
+	c.Check(got, DeepEquals, []string{"TITLE=a", `PATH=C:\music\a.flac`})
+
+	_, err = readTags(strings.NewReader("TITLE=a\nno equals sign\n"))
+	c.Check(err, ErrorMatches, `line 2: malformed comment "no equals sign"; expected NAME=value`)
+	_, err = readTags(strings.NewReader("BAD\\nNAME=a\n"))
+	c.Check(err, ErrorMatches, `line 1: invalid field name "BAD\\nNAME"`)
+}
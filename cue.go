@@ -0,0 +1,62 @@
+// cue.go - Conversion of FLAC cuesheets to .cue files.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package flac
+
+import (
+	"fmt"
+	"strings"
+)
+
+// cdFrameSamples is the number of samples in a CD-DA frame: 44100 samples a
+// second at 75 frames a second.
+const cdFrameSamples = 588
+
+// cueTime formats a sample offset as the MM:SS:FF position of a .cue file.
+func cueTime(samples uint64) string {
+	frames := samples / cdFrameSamples
+	return fmt.Sprintf("%02d:%02d:%02d", frames/(75*60), frames/75%60, frames%75)
+}
+
+// ToCueString returns cb as the text of a .cue sheet for the audio in
+// flacFilename: the CATALOG, a FILE line, and the TRACK, FLAGS, ISRC and
+// INDEX lines of every track but the lead-out. Offsets are converted to
+// MM:SS:FF at 75 frames a second, assuming CD-DA's 44.1 kHz sample rate.
+func (cb *CuesheetBlock) ToCueString(flacFilename string) string {
+	var b strings.Builder
+	if mcn := strings.TrimRight(cb.MediaCatalogNumber, "\x00"); mcn != "" {
+		fmt.Fprintf(&b, "CATALOG %s\n", mcn)
+	}
+	fmt.Fprintf(&b, "FILE \"%s\" WAVE\n", flacFilename)
+
+	for _, ctb := range cb.CuesheetTracks {
+		if ctb.TrackNumber == 170 || ctb.TrackNumber == 255 {
+			continue // lead-out
+		}
+		mode := "AUDIO"
+		if ctb.TrackType != 0 {
+			mode = "MODE1/2352"
+		}
+		fmt.Fprintf(&b, "  TRACK %02d %s\n", ctb.TrackNumber, mode)
+		if ctb.PreEmphasis {
+			b.WriteString("    FLAGS PRE\n")
+		}
+		if isrc := strings.TrimRight(ctb.TrackISRC, "\x00"); isrc != "" {
+			fmt.Fprintf(&b, "    ISRC %s\n", isrc)
+		}
+		for _, cti := range ctb.CuesheetTrackIndexes {
+			fmt.Fprintf(&b, "    INDEX %02d %s\n", cti.IndexPoint, cueTime(ctb.TrackOffset+cti.SampleOffset))
+		}
+	}
+	return b.String()
+}
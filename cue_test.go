@@ -0,0 +1,33 @@
+package flac
+
+import (
+	. "launchpad.net/gocheck"
+)
+
+func (s *S) TestCuesheetToCueString(c *C) {
+	cb := &CuesheetBlock{
+		MediaCatalogNumber: "1234567890123" + string(make([]byte, 115)),
+		IsCompactDisc:      true,
+		TotalTracks:        3,
+		CuesheetTracks: []*CuesheetTrackBlock{
+			{TrackOffset: 0, TrackNumber: 1, TrackISRC: "USRC17607839", IndexPoints: 1,
+				CuesheetTrackIndexes: []*CuesheetTrackIndexBlock{{SampleOffset: 0, IndexPoint: 1}}},
+			{TrackOffset: 588 * (75*(4*60+5) + 12), TrackNumber: 2, TrackISRC: string(make([]byte, 12)),
+				PreEmphasis: true, IndexPoints: 2,
+				CuesheetTrackIndexes: []*CuesheetTrackIndexBlock{
+					{SampleOffset: 0, IndexPoint: 0},
+					{SampleOffset: 588 * 150, IndexPoint: 1}}},
+			{TrackOffset: 588 * 75 * 600, TrackNumber: 170},
+		}}
+
+	c.Check(cb.ToCueString("album.flac"), Equals, `CATALOG 1234567890123
+FILE "album.flac" WAVE
+  TRACK 01 AUDIO
+    ISRC USRC17607839
+    INDEX 01 00:00:00
+  TRACK 02 AUDIO
+    FLAGS PRE
+    INDEX 00 04:05:12
+    INDEX 01 04:07:12
+`)
+}
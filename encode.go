@@ -0,0 +1,502 @@
+// encode.go - Serialization of FLAC metadata.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// encodeHeader packs the fields of a metadata block header into its 4 byte
+// big-endian form. Callers must first check that length fits in 24 bits.
+func encodeHeader(t MetadataBlockType, length uint32, last bool) []byte {
+	bits := uint32(t)<<24 | length&MetadataBlockMaxLength
+	if last {
+		bits |= 0x80000000
+	}
+	b := make([]byte, MetadataBlockHeaderLen/8)
+	binary.BigEndian.PutUint32(b, bits)
+	return b
+}
+
+// Encode packs mbh into the 4 byte METADATA_BLOCK_HEADER that
+// MetadataBlockHeader.Parse reads. Block type 127 and types that do not fit
+// in 7 bits cannot be encoded, nor can a Length above MetadataBlockMaxLength.
+func (mbh *MetadataBlockHeader) Encode() ([]byte, error) {
+	if mbh.Type >= MetadataInvalid {
+		return nil, fmt.Errorf("FATAL: cannot encode invalid block type: %d.", uint8(mbh.Type))
+	}
+	if mbh.Length > MetadataBlockMaxLength {
+		return nil, fmt.Errorf("FATAL: %s block of %d bytes does not fit in a metadata block: %w", mbh.Type, mbh.Length, ErrBlockTooLarge)
+	}
+	return encodeHeader(mbh.Type, mbh.Length, mbh.Last), nil
+}
+
+// EncodeOptions controls how VorbisCommentBlock.EncodeWith serializes a
+// block, and so how Metadata.WriteToWith, RewriteVorbisCommentWith and
+// WriteVorbisCommentInPlaceWith write one. The zero value writes the block
+// as it is.
+type EncodeOptions struct {
+	// SortComments writes the comments ordered by field name, ignoring
+	// case, so the same tags always give the same bytes. Comments with the
+	// same field name keep their order.
+	SortComments bool
+
+	// Vendor, if not empty, is written as the vendor string in place of
+	// the block's own, as taggers stamp their name on the blocks they
+	// write.
+	Vendor string
+}
+
+// Encode serializes a Vorbis comment block: the vendor string, the number of
+// comments and each comment, every length being a little-endian 32 bit
+// integer. The comment count written is len(vcb.Comments).
+func (vcb *VorbisCommentBlock) Encode() []byte {
+	return vcb.EncodeWith(EncodeOptions{})
+}
+
+// EncodeWith is Encode with options. vcb itself is not changed.
+func (vcb *VorbisCommentBlock) EncodeWith(opts EncodeOptions) []byte {
+	var buf bytes.Buffer
+	b := make([]byte, VorbisCommentVendorLen/8)
+
+	comments := vcb.Comments
+	if opts.SortComments {
+		comments = append([]string(nil), comments...)
+		sort.SliceStable(comments, func(i, j int) bool {
+			return commentKey(comments[i]) < commentKey(comments[j])
+		})
+	}
+
+	vendor := vcb.Vendor
+	if opts.Vendor != "" {
+		vendor = opts.Vendor
+	}
+
+	binary.LittleEndian.PutUint32(b, uint32(len(vendor)))
+	buf.Write(b)
+	buf.WriteString(vendor)
+
+	binary.LittleEndian.PutUint32(b, uint32(len(comments)))
+	buf.Write(b)
+
+	for _, comment := range comments {
+		binary.LittleEndian.PutUint32(b, uint32(len(comment)))
+		buf.Write(b)
+		buf.WriteString(comment)
+	}
+	return buf.Bytes()
+}
+
+// commentKey returns the upper-cased field name of a comment, or the whole
+// comment if it has no '='.
+func commentKey(comment string) string {
+	key, _, _ := strings.Cut(comment, "=")
+	return strings.ToUpper(key)
+}
+
+// Encode serializes the 34 byte body of a STREAMINFO block, the inverse of
+// StreaminfoBlock.Parse: Channels and BitsPerSample are stored less one.
+// A block that fails Validate is not encoded, as a field out of range
+// would not fit its bits. MD5 is written and MD5Signature ignored.
+func (sib *StreaminfoBlock) Encode() ([]byte, error) {
+	if err := sib.Validate(); err != nil {
+		return nil, err
+	}
+	return sib.encode(), nil
+}
+
+// encode serializes the 34 byte body of a STREAMINFO block. Callers must
+// first check the fields with Validate.
+func (sib *StreaminfoBlock) encode() []byte {
+	b := make([]byte, 0, 34)
+	b = binary.BigEndian.AppendUint16(b, sib.MinBlockSize)
+	b = binary.BigEndian.AppendUint64(b, uint64(sib.MaxBlockSize)<<48|
+		uint64(sib.MinFrameSize&0xFFFFFF)<<24|
+		uint64(sib.MaxFrameSize&0xFFFFFF))
+	b = binary.BigEndian.AppendUint64(b, uint64(sib.SampleRate&0xFFFFF)<<44|
+		uint64((sib.Channels-1)&0x07)<<41|
+		uint64((sib.BitsPerSample-1)&0x1F)<<36|
+		sib.TotalSamples&0xFFFFFFFFF)
+	return append(b, sib.MD5[:]...)
+}
+
+// encode serializes a PADDING block of pb.Length zero bytes.
+func (pb *PaddingBlock) encode() []byte {
+	return make([]byte, pb.Length)
+}
+
+// encode serializes an APPLICATION block: the 4 byte ID and the data.
+func (ab *ApplicationBlock) encode() []byte {
+	return append(binary.BigEndian.AppendUint32(nil, ab.Id), ab.Data...)
+}
+
+// Encode serializes a SEEKTABLE block, the inverse of Seektable.Parse: each
+// 18 byte seek point in the order of stb.Data, with a placeholder point
+// written as it is stored, with sample number SeekpointPlaceholder. The
+// points are not sorted; the format wants them in ascending order with the
+// placeholders last.
+func (stb *Seektable) Encode() []byte {
+	return stb.encode()
+}
+
+// encode serializes the 18 byte seek points of a SEEKTABLE block.
+func (stb *Seektable) encode() []byte {
+	b := make([]byte, 0, len(stb.Data)*SeekpointBlockLen/8)
+	for _, spb := range stb.Data {
+		b = binary.BigEndian.AppendUint64(b, spb.SampleNumber)
+		b = binary.BigEndian.AppendUint64(b, spb.Offset)
+		b = binary.BigEndian.AppendUint16(b, spb.FrameSamples)
+	}
+	return b
+}
+
+// fixedString returns s truncated or padded with NULs to n bytes.
+func fixedString(s string, n int) []byte {
+	b := make([]byte, n)
+	copy(b, s)
+	return b
+}
+
+// encode serializes a CUESHEET block with its tracks and index points. The
+// track and index counts written are the lengths of the slices.
+func (cb *CuesheetBlock) encode() []byte {
+	b := fixedString(cb.MediaCatalogNumber, CuesheetMediaCatalogNumberLen/8)
+	b = binary.BigEndian.AppendUint64(b, cb.LeadinSamples)
+	reserved := make([]byte, CuesheetReservedLen/8)
+	if cb.IsCompactDisc {
+		reserved[0] = 0x80
+	}
+	b = append(b, reserved...)
+	b = append(b, uint8(len(cb.CuesheetTracks)))
+
+	for _, ctb := range cb.CuesheetTracks {
+		b = binary.BigEndian.AppendUint64(b, ctb.TrackOffset)
+		b = append(b, ctb.TrackNumber)
+		b = append(b, fixedString(ctb.TrackISRC, CuesheetTrackTrackISRCLen/8)...)
+		reserved := make([]byte, CuesheetTrackReservedLen/8)
+		reserved[0] = ctb.TrackType << 7
+		if ctb.PreEmphasis {
+			reserved[0] |= 0x40
+		}
+		b = append(b, reserved...)
+		b = append(b, uint8(len(ctb.CuesheetTrackIndexes)))
+
+		for _, cti := range ctb.CuesheetTrackIndexes {
+			b = binary.BigEndian.AppendUint64(b, cti.SampleOffset)
+			b = append(b, cti.IndexPoint)
+			b = append(b, make([]byte, CuesheetTrackIndexReservedLen/8)...)
+		}
+	}
+	return b
+}
+
+// Encode serializes a PICTURE block, the inverse of PictureBlock.Parse: the
+// picture type, the MIME type and description each after its length, the
+// width, height, color depth and number of colors, and the data after its
+// length, all big-endian. The data length written is len(pb.PictureBlob),
+// not Length. The strings and data must each have a length that fits in 32
+// bits; to fit in a metadata block the whole must be at most
+// MetadataBlockMaxLength bytes, which is not checked here.
+func (pb *PictureBlock) Encode() ([]byte, error) {
+	for _, f := range []struct {
+		name string
+		n    int
+	}{{"MIME type", len(pb.MimeType)}, {"description", len(pb.PictureDescription)}, {"data", len(pb.PictureBlob)}} {
+		if uint64(f.n) > math.MaxUint32 {
+			return nil, fmt.Errorf("FATAL: picture %s of %d bytes does not fit in a 32 bit length.", f.name, f.n)
+		}
+	}
+	return pb.encode(), nil
+}
+
+// encode serializes a PICTURE block. The data length written is
+// len(pb.PictureBlob).
+func (pb *PictureBlock) encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, pb.PictureTypeId)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(pb.MimeType)))
+	b = append(b, pb.MimeType...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(pb.PictureDescription)))
+	b = append(b, pb.PictureDescription...)
+	for _, v := range []uint32{pb.Width, pb.Height, pb.ColorDepth, pb.NumColors, uint32(len(pb.PictureBlob))} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return append(b, pb.PictureBlob...)
+}
+
+// encodeBlock returns the serialized data of b, one of meta.Blocks: its
+// Raw data if the block is unmodified, otherwise the encoding of its
+// decoded fields. A VORBIS_COMMENT block is always encoded with opts if
+// they are not the zero value. A modified STREAMINFO block must pass
+// Validate.
+func (meta *Metadata) encodeBlock(b *Block, opts EncodeOptions) ([]byte, error) {
+	if b.Header.Type == MetadataVorbisComment && opts != (EncodeOptions{}) {
+		return meta.VorbisCommentOf(b.Header).EncodeWith(opts), nil
+	}
+	if meta.unmodified(b) {
+		return b.Raw, nil
+	}
+	switch b.Header.Type {
+	case MetadataStreaminfo:
+		return meta.Streaminfo.Data.Encode()
+	case MetadataPadding:
+		// There may be several PADDING blocks, so each keeps its own length.
+		return (&PaddingBlock{Length: b.Header.Length}).encode(), nil
+	case MetadataApplication:
+		return meta.Application.Data.encode(), nil
+	case MetadataSeektable:
+		return meta.Seektable.encode(), nil
+	case MetadataVorbisComment:
+		return meta.VorbisCommentOf(b.Header).Encode(), nil
+	case MetadataCuesheet:
+		return meta.Cuesheet.Data.encode(), nil
+	case MetadataPicture:
+		for _, pic := range meta.Pictures {
+			if pic.Header == b.Header {
+				return pic.Data.encode(), nil
+			}
+		}
+	}
+	return b.Raw, nil
+}
+
+// unmodified reports whether Raw, the data b was read with, still holds
+// what the decoded fields of meta say for it. Raw is decoded afresh and
+// compared with them, so a change made through any field is noticed, and so
+// is a block whose Header.Length no longer matches Raw.
+func (meta *Metadata) unmodified(b *Block) bool {
+	if b.Raw == nil || uint32(len(b.Raw)) != b.Header.Length {
+		return false
+	}
+	same := func(fresh interface{ Parse([]byte) error }, cur interface{}) bool {
+		return fresh.Parse(b.Raw) == nil && reflect.DeepEqual(fresh, cur)
+	}
+	switch b.Header.Type {
+	case MetadataStreaminfo:
+		return same(new(StreaminfoBlock), meta.Streaminfo.Data)
+	case MetadataPadding:
+		return true
+	case MetadataApplication:
+		return same(new(ApplicationBlock), meta.Application.Data)
+	case MetadataSeektable:
+		stb := new(Seektable)
+		return stb.Parse(b.Raw) == nil && reflect.DeepEqual(stb.Data, meta.Seektable.Data)
+	case MetadataVorbisComment:
+		return same(new(VorbisCommentBlock), meta.VorbisCommentOf(b.Header))
+	case MetadataCuesheet:
+		return same(new(CuesheetBlock), meta.Cuesheet.Data)
+	case MetadataPicture:
+		for _, pic := range meta.Pictures {
+			if pic.Header == b.Header {
+				return same(new(PictureBlock), pic.Data)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// WriteTo writes the "fLaC" signature and every block in meta.Blocks to w,
+// in order. A block that is unchanged since it was read is written from
+// Raw byte for byte, as are blocks of types this package does not
+// recognize; any other is serialized from its decoded fields, with padding
+// written as zero bytes. Each block is given a header with its length, and
+// only the final block is flagged as the last. A modified STREAMINFO block
+// that fails StreaminfoBlock.Validate is an error, as its fields would not
+// fit their bits.
+func (meta *Metadata) WriteTo(w io.Writer) (int64, error) {
+	return meta.WriteToWith(w, EncodeOptions{})
+}
+
+// WriteToWith is WriteTo with options for the VORBIS_COMMENT blocks, which
+// are encoded with them even if unchanged.
+func (meta *Metadata) WriteToWith(w io.Writer, opts EncodeOptions) (int64, error) {
+	n, err := io.WriteString(w, FlacSignature)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+
+	for i, b := range meta.Blocks {
+		data, err := meta.encodeBlock(b, opts)
+		if err != nil {
+			return total, err
+		}
+		if len(data) > MetadataBlockMaxLength {
+			return total, fmt.Errorf("FATAL: %s block of %d bytes does not fit in a metadata block: %w", b.Header.Type, len(data), ErrBlockTooLarge)
+		}
+		mbh := &MetadataBlockHeader{Type: b.Header.Type, Length: uint32(len(data)), Last: i == len(meta.Blocks)-1}
+		h, err := mbh.Encode()
+		if err != nil {
+			return total, err
+		}
+		n, err = w.Write(h)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+		n, err = w.Write(data)
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// checkNotOgg reads the start of r and returns a reader of the whole of it,
+// or an error if r is an Ogg stream. ParseMetadata reads Ogg FLAC, but the
+// editors here write native FLAC blocks at native FLAC offsets and so would
+// corrupt the Ogg pages.
+func checkNotOgg(r io.Reader) (io.Reader, error) {
+	sig := make([]byte, len(OggSignature))
+	n, _ := io.ReadFull(r, sig)
+	if string(sig[:n]) == OggSignature {
+		return nil, fmt.Errorf("FATAL: cannot edit the metadata of an Ogg FLAC file; only native FLAC is supported.")
+	}
+	return io.MultiReader(bytes.NewReader(sig[:n]), r), nil
+}
+
+// RewriteVorbisComment copies the FLAC stream in r to w, replacing its
+// VORBIS_COMMENT block with vcb. Every other metadata block, including
+// padding, and the audio frames are copied unchanged. If r has no
+// VORBIS_COMMENT block, vcb is appended as the last metadata block. An
+// ID3v2 tag before the "fLaC" signature is not copied. Ogg FLAC is not
+// supported.
+func RewriteVorbisComment(r io.Reader, w io.Writer, vcb *VorbisCommentBlock) error {
+	return RewriteVorbisCommentWith(r, w, vcb, EncodeOptions{})
+}
+
+// RewriteVorbisCommentWith is RewriteVorbisComment with vcb encoded with
+// opts.
+func RewriteVorbisCommentWith(r io.Reader, w io.Writer, vcb *VorbisCommentBlock, opts EncodeOptions) error {
+	comment := vcb.EncodeWith(opts)
+	if len(comment) > MetadataBlockMaxLength {
+		return fmt.Errorf("FATAL: %s block of %d bytes does not fit in a metadata block: %w", MetadataVorbisComment, len(comment), ErrBlockTooLarge)
+	}
+	r, err := checkNotOgg(r)
+	if err != nil {
+		return err
+	}
+
+	// WalkMetadata checks and consumes the signature, so it is written
+	// along with the first block.
+	blocks, wrote := 0, false
+	write := func(h, block []byte) error {
+		if blocks == 0 {
+			if _, err := io.WriteString(w, FlacSignature); err != nil {
+				return err
+			}
+		}
+		blocks++
+		if _, err := w.Write(h); err != nil {
+			return err
+		}
+		_, err := w.Write(block)
+		return err
+	}
+
+	err = WalkMetadata(r, func(mbh *MetadataBlockHeader, block []byte) error {
+		h := encodeHeader(mbh.Type, mbh.Length, mbh.Last)
+		if mbh.Type == MetadataVorbisComment && !wrote {
+			h, block = encodeHeader(MetadataVorbisComment, uint32(len(comment)), mbh.Last), comment
+			wrote = true
+		} else if mbh.Last && !wrote {
+			h = encodeHeader(mbh.Type, mbh.Length, false)
+		}
+		return write(h, block)
+	})
+	if err != nil {
+		return err
+	}
+	if !wrote {
+		if err := write(encodeHeader(MetadataVorbisComment, uint32(len(comment)), true), comment); err != nil {
+			return err
+		}
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// WriteVorbisCommentInPlace overwrites the VORBIS_COMMENT block of the FLAC
+// file f with vcb without moving the audio frames. The PADDING block that
+// must immediately follow the VORBIS_COMMENT block is shrunk or grown by the
+// change in size. If the file has no such padding, or too little of it, f is
+// left unchanged and an error wrapping ErrNoRoom is returned; the caller can
+// then fall back to RewriteVorbisComment. An Ogg FLAC file is left
+// unchanged and is an error.
+func WriteVorbisCommentInPlace(f io.ReadWriteSeeker, vcb *VorbisCommentBlock) error {
+	return WriteVorbisCommentInPlaceWith(f, vcb, EncodeOptions{})
+}
+
+// WriteVorbisCommentInPlaceWith is WriteVorbisCommentInPlace with vcb
+// encoded with opts.
+func WriteVorbisCommentInPlaceWith(f io.ReadWriteSeeker, vcb *VorbisCommentBlock, opts EncodeOptions) error {
+	comment := vcb.EncodeWith(opts)
+	if len(comment) > MetadataBlockMaxLength {
+		return fmt.Errorf("FATAL: %s block of %d bytes does not fit in a metadata block: %w", MetadataVorbisComment, len(comment), ErrBlockTooLarge)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := checkNotOgg(f); err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	meta, err := ParseMetadata(f)
+	if err != nil {
+		return err
+	}
+
+	var vc, pad *Block
+	for i, b := range meta.Blocks {
+		if b.Header.Type == MetadataVorbisComment && i+1 < len(meta.Blocks) {
+			vc, pad = b, meta.Blocks[i+1]
+			break
+		}
+	}
+	if vc == nil || pad.Header.Type != MetadataPadding {
+		return fmt.Errorf("FATAL: no %s block follows the %s block: %w", MetadataPadding, MetadataVorbisComment, ErrNoRoom)
+	}
+
+	room := int64(vc.Header.Length) + int64(pad.Header.Length)
+	padding := room - int64(len(comment))
+	if padding < 0 {
+		return fmt.Errorf("FATAL: %s block of %d bytes needs %d more byte(s) of padding: %w", MetadataVorbisComment, len(comment), -padding, ErrNoRoom)
+	}
+	if padding > MetadataBlockMaxLength {
+		return fmt.Errorf("FATAL: %s block of %d bytes does not fit in a metadata block: %w", MetadataPadding, padding, ErrBlockTooLarge)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(encodeHeader(MetadataVorbisComment, uint32(len(comment)), false))
+	buf.Write(comment)
+	buf.Write(encodeHeader(MetadataPadding, uint32(padding), pad.Header.Last))
+	buf.Write(make([]byte, padding))
+
+	if _, err := f.Seek(vc.Offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	return err
+}
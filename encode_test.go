@@ -0,0 +1,536 @@
+package flac
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	. "launchpad.net/gocheck"
+	"os"
+	"path/filepath"
+)
+
+func (s *S) TestEncodeMetadataBlockHeaderRoundTrip(c *C) {
+	for _, h := range [][]byte{
+		{0x00, 0x00, 0x00, 0x22},
+		{0x84, 0x00, 0x01, 0x2c},
+		{0x81, 0xff, 0xff, 0xff},
+		{0x06, 0x12, 0x34, 0x56},
+		{0x7e, 0x00, 0x00, 0x00},
+	} {
+		mbh := new(MetadataBlockHeader)
+		c.Assert(mbh.Parse(h), IsNil)
+		b, err := mbh.Encode()
+		c.Assert(err, IsNil)
+		c.Check(b, DeepEquals, h)
+	}
+
+	_, err := (&MetadataBlockHeader{Type: MetadataInvalid}).Encode()
+	c.Check(err, ErrorMatches, "FATAL: cannot encode invalid block type: 127.")
+}
+
+func (s *S) TestEncodeMetadataBlockHeaderTooLarge(c *C) {
+	mbh := &MetadataBlockHeader{Type: MetadataPicture, Length: MetadataBlockMaxLength}
+	_, err := mbh.Encode()
+	c.Check(err, IsNil)
+
+	mbh.Length++
+	_, err = mbh.Encode()
+	c.Check(err, ErrorMatches, "FATAL: PICTURE block of 16777216 bytes does not fit in a metadata block: .*")
+	c.Check(errors.Is(err, ErrBlockTooLarge), Equals, true)
+}
+
+func (s *S) TestEncodeStreaminfo(c *C) {
+	sib := &StreaminfoBlock{
+		MinBlockSize:  4096,
+		MaxBlockSize:  4096,
+		MinFrameSize:  14,
+		MaxFrameSize:  0xFFFFFF - 1,
+		SampleRate:    655349,
+		Channels:      8,
+		BitsPerSample: 32,
+		TotalSamples:  StreaminfoTotalSamplesMaximum - 1,
+	}
+	copy(sib.MD5[:], "0123456789abcdef")
+	sib.MD5Signature = sib.MD5.String()
+
+	b, err := sib.Encode()
+	c.Assert(err, IsNil)
+	c.Check(b, HasLen, 34)
+	got := new(StreaminfoBlock)
+	c.Assert(got.Parse(b), IsNil)
+	c.Check(*got, Equals, *sib)
+
+	b, err = (&StreaminfoBlock{MinBlockSize: 16, MaxBlockSize: 16, SampleRate: 44100, Channels: 9, BitsPerSample: 16}).Encode()
+	c.Check(err, ErrorMatches, "FATAL: invalid Channels: 9. Must be between 1 and 8.")
+	c.Check(b, IsNil)
+	_, err = (&StreaminfoBlock{MinBlockSize: 16, MaxBlockSize: 16, SampleRate: 44100, Channels: 2, BitsPerSample: 16, TotalSamples: 1 << 36}).Encode()
+	c.Check(err, ErrorMatches, "FATAL: invalid TotalSamples: .* Must fit in 36 bits.")
+}
+
+func (s *S) TestEncodePicture(c *C) {
+	for _, block := range [][]byte{
+		mkPicture(PictureCoverFront, "image/png", "front", []byte("png")),
+		mkPicture(PictureOther, "-->", "", []byte("http://example.com/cover.jpg")),
+		mkPicture(PictureBrightColouredFish, "", "", nil),
+	} {
+		pb := new(PictureBlock)
+		c.Assert(pb.Parse(block), IsNil)
+		b, err := pb.Encode()
+		c.Assert(err, IsNil)
+		c.Check(b, DeepEquals, block)
+	}
+}
+
+func (s *S) TestEncodeSeektable(c *C) {
+	block := []byte{
+		0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x04, 0xd2, 0x10, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	stb := new(Seektable)
+	c.Assert(stb.Parse(block), IsNil)
+	c.Check(stb.Encode(), DeepEquals, block)
+
+	stb = &Seektable{Data: []*SeekpointBlock{
+		{SampleNumber: 0, Offset: 0, FrameSamples: 4096},
+		{SampleNumber: SeekpointPlaceholder}}}
+	b := stb.Encode()
+	c.Assert(b, HasLen, 2*SeekpointBlockLen/8)
+	c.Check(b[18:26], DeepEquals, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	got := new(Seektable)
+	c.Assert(got.Parse(b), IsNil)
+	c.Check(got.Data, DeepEquals, stb.Data)
+	c.Check(new(Seektable).Encode(), HasLen, 0)
+}
+
+func (s *S) TestMetadataWriteToRoundTrip(c *C) {
+	vc := &VorbisCommentBlock{Vendor: "v", TotalComments: 1, Comments: []string{"TITLE=t"}}
+	seekpoints := []byte{
+		0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x04, 0xd2, 0x10, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	track := mkCuesheetTrack(0, 1, 0, 588)
+	copy(track[9:], "USRC17607839")
+	track[21] = 0xc0
+	cuesheet := mkCuesheet(true, track, mkCuesheetTrack(588*75, 170))
+	copy(cuesheet, "1234567890123")
+
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataApplication, false, []byte("riffWAVE")),
+		mkBlock(MetadataSeektable, false, seekpoints),
+		mkBlock(MetadataVorbisComment, false, vc.Encode()),
+		mkBlock(MetadataCuesheet, false, cuesheet),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverFront, "image/png", "front", []byte("png"))),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverBack, "image/jpeg", "back", []byte("jpeg"))),
+		mkBlock(MetadataBlockType(100), false, []byte("raw")),
+		mkBlock(MetadataPadding, true, make([]byte, 1000)))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	var out bytes.Buffer
+	n, err := meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	c.Check(n, Equals, int64(len(stream)))
+	c.Check(out.Bytes(), DeepEquals, stream)
+}
+
+func (s *S) TestMetadataWriteToRaw(c *C) {
+	// Nonzero reserved bits and padding do not survive re-encoding, so
+	// they show whether a block was written from Raw.
+	cuesheet := mkCuesheet(false, mkCuesheetTrack(0, 1, 0, 0), mkCuesheetTrack(588*75, 170))
+	cuesheet[137] = 0x5a
+	padding := bytes.Repeat([]byte{0xee}, 16)
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, mkVorbisComment(1)),
+		mkBlock(MetadataCuesheet, false, cuesheet),
+		mkBlock(MetadataPadding, true, padding))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	for _, b := range meta.Blocks {
+		c.Check(b.Raw, HasLen, int(b.Header.Length))
+	}
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	c.Check(out.Bytes(), DeepEquals, stream)
+
+	meta.VorbisComment.Data.Add("TITLE", "edited")
+	out.Reset()
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	got, err := ParseMetadataBytes(out.Bytes())
+	c.Assert(err, IsNil)
+	title, _ := got.VorbisComment.Data.Get("TITLE")
+	c.Check(title, Equals, "edited")
+	c.Check(got.Cuesheet.Header.Length, Equals, uint32(len(cuesheet)))
+	c.Check(got.Blocks[2].Raw, DeepEquals, cuesheet)
+	c.Check(got.Blocks[3].Raw, DeepEquals, padding)
+
+	// A change to the cuesheet itself re-encodes it.
+	meta.Cuesheet.Data.LeadinSamples = 88200
+	out.Reset()
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	got, err = ParseMetadataBytes(out.Bytes())
+	c.Assert(err, IsNil)
+	c.Check(got.Cuesheet.Data.LeadinSamples, Equals, uint64(88200))
+	c.Check(got.Blocks[2].Raw[137], Equals, byte(0))
+	c.Check(got.Blocks[3].Raw, DeepEquals, padding)
+}
+
+func (s *S) TestMetadataWriteToInvalidStreaminfo(c *C) {
+	meta, err := ParseMetadata(bytes.NewReader(mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))))
+	c.Assert(err, IsNil)
+
+	meta.Streaminfo.Data.Channels = 9
+	_, err = meta.WriteTo(io.Discard)
+	c.Check(err, ErrorMatches, "FATAL: invalid Channels: 9. Must be between 1 and 8.")
+
+	meta.Streaminfo.Data.Channels, meta.Streaminfo.Data.BitsPerSample = 2, 40
+	_, err = meta.WriteTo(io.Discard)
+	c.Check(err, ErrorMatches, "FATAL: invalid BitsPerSample: 40. Must be between 4 and 32.")
+}
+
+func (s *S) TestMetadataWriteToLastFlag(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, (&VorbisCommentBlock{Vendor: "v", Comments: []string{}}).Encode()),
+		mkBlock(MetadataPadding, true, make([]byte, 10)))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	meta.Blocks = meta.Blocks[:2]
+	meta.VorbisComment.Data.Add("TITLE", "grown")
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	got, err := ParseMetadata(&out)
+	c.Assert(err, IsNil)
+	c.Check(got.BlockTypes(), DeepEquals, []string{"STREAMINFO", "VORBIS_COMMENT"})
+	c.Check(got.VorbisComment.Header.Last, Equals, true)
+	c.Check(got.VorbisComment.Data.Comments, DeepEquals, []string{"TITLE=grown"})
+	c.Check(out.Len(), Equals, 0)
+}
+
+func (s *S) TestMetadataAddPadding(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, false, make([]byte, 10)),
+		mkBlock(MetadataApplication, true, []byte("riffWAVE")))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	meta.AddPadding(4096)
+	c.Check(meta.Application.Header.Last, Equals, false)
+	c.Check(meta.MetadataLength(), Equals, int64(len(stream)+4+4096))
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	got, err := ParseMetadata(&out)
+	c.Assert(err, IsNil)
+	c.Check(got.BlockTypes(), DeepEquals, []string{"STREAMINFO", "PADDING", "APPLICATION", "PADDING"})
+	c.Check(got.Padding.Data.Length, Equals, uint32(10))
+	c.Check(got.Blocks[3].Header, DeepEquals, &MetadataBlockHeader{Type: MetadataPadding, Length: 4096, Last: true})
+}
+
+func (s *S) TestMetadataAvailablePadding(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, false, make([]byte, 100)),
+		mkBlock(MetadataApplication, false, []byte("test1234")),
+		mkBlock(MetadataPadding, true, make([]byte, 50)))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Check(meta.AvailablePadding(), Equals, 158)
+
+	meta.RemovePadding()
+	c.Check(meta.AvailablePadding(), Equals, 0)
+}
+
+func (s *S) TestMetadataRemovePadding(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, false, make([]byte, 10)),
+		mkBlock(MetadataApplication, false, []byte("riffWAVE")),
+		mkBlock(MetadataPadding, true, make([]byte, 20)))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	meta.RemovePadding()
+	c.Check(meta.BlockTypes(), DeepEquals, []string{"STREAMINFO", "APPLICATION"})
+	c.Check(meta.Padding.IsPopulated, Equals, false)
+	c.Check(meta.Application.Header.Last, Equals, true)
+	c.Check(meta.Blocks[1].Offset, Equals, int64(42))
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	c.Check(out.Bytes(), DeepEquals, mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataApplication, true, []byte("riffWAVE"))))
+}
+
+func (s *S) TestMetadataStripToStreamInfo(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataApplication, false, []byte("riffWAVE")),
+		mkBlock(MetadataVorbisComment, false, mkVorbisComment(2)),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverFront, "image/png", "front", []byte("png"))),
+		mkBlock(MetadataBlockType(100), false, []byte("raw")),
+		mkBlock(MetadataPadding, true, make([]byte, 20)))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	meta.StripToStreamInfo()
+	c.Check(meta.BlockTypes(), DeepEquals, []string{"STREAMINFO"})
+	c.Check(meta.Streaminfo.Header.Last, Equals, true)
+	c.Check(meta.PrimaryComments(), IsNil)
+	c.Check(meta.Pictures, IsNil)
+	c.Check(meta.Application.IsPopulated, Equals, false)
+	c.Check(meta.Padding.IsPopulated, Equals, false)
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	c.Check(out.Bytes(), DeepEquals, mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo())))
+}
+
+func (s *S) TestEncodeVorbisCommentRoundTrip(c *C) {
+	vcb := &VorbisCommentBlock{
+		Vendor:        "reference libFLAC 1.2.1 20070917",
+		TotalComments: 3,
+		Comments:      []string{"ARTIST=GoGoGo", "TITLE=Silence", "EMPTY="}}
+
+	parsed := new(VorbisCommentBlock)
+	c.Assert(parsed.Parse(vcb.Encode()), IsNil)
+	c.Check(parsed, DeepEquals, vcb)
+}
+
+func (s *S) TestEncodeVorbisCommentSorted(c *C) {
+	vcb := &VorbisCommentBlock{Vendor: "v", Comments: []string{"TITLE=t", "artist=b", "ALBUM=x", "ARTIST=a"}}
+	parsed := new(VorbisCommentBlock)
+	c.Assert(parsed.Parse(vcb.EncodeWith(EncodeOptions{SortComments: true})), IsNil)
+	c.Check(parsed.Comments, DeepEquals, []string{"ALBUM=x", "artist=b", "ARTIST=a", "TITLE=t"})
+	c.Check(vcb.Comments[0], Equals, "TITLE=t")
+
+	other := &VorbisCommentBlock{Vendor: "v", Comments: []string{"ALBUM=x", "TITLE=t", "artist=b", "ARTIST=a"}}
+	c.Check(other.EncodeWith(EncodeOptions{SortComments: true}), DeepEquals, vcb.EncodeWith(EncodeOptions{SortComments: true}))
+	c.Check(vcb.EncodeWith(EncodeOptions{}), DeepEquals, vcb.Encode())
+}
+
+func (s *S) TestEncodeVorbisCommentVendor(c *C) {
+	vcb := &VorbisCommentBlock{Vendor: "reference libFLAC 1.2.1 20070917", Comments: []string{"TITLE=t"}}
+	parsed := new(VorbisCommentBlock)
+	c.Assert(parsed.Parse(vcb.EncodeWith(EncodeOptions{Vendor: "goflac-meta 1.0"})), IsNil)
+	c.Check(parsed.Vendor, Equals, "goflac-meta 1.0")
+	c.Check(parsed.Comments, DeepEquals, vcb.Comments)
+	c.Check(vcb.Vendor, Equals, "reference libFLAC 1.2.1 20070917")
+
+	c.Assert(parsed.Parse(vcb.EncodeWith(EncodeOptions{})), IsNil)
+	c.Check(parsed.Vendor, Equals, vcb.Vendor)
+}
+
+func (s *S) TestWriteSortCommentsOption(c *C) {
+	// The same tags in a different order give the same file.
+	file := func(comments ...string) []byte {
+		vcb := &VorbisCommentBlock{Vendor: "v", TotalComments: uint32(len(comments)), Comments: comments}
+		return mkStream(
+			mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+			mkBlock(MetadataVorbisComment, false, vcb.Encode()),
+			mkBlock(MetadataPadding, true, make([]byte, 64)))
+	}
+	a := file("TITLE=t", "ARTIST=a", "ALBUM=x")
+	b := file("ALBUM=x", "TITLE=t", "ARTIST=a")
+	opts := EncodeOptions{SortComments: true}
+
+	write := func(stream []byte) []byte {
+		meta, err := ParseMetadata(bytes.NewReader(stream))
+		c.Assert(err, IsNil)
+		var out bytes.Buffer
+		_, err = meta.WriteToWith(&out, opts)
+		c.Assert(err, IsNil)
+		return out.Bytes()
+	}
+	c.Check(write(a), DeepEquals, write(b))
+	c.Check(write(a), Not(DeepEquals), a)
+
+	rewrite := func(stream []byte) []byte {
+		meta, err := ParseMetadata(bytes.NewReader(stream))
+		c.Assert(err, IsNil)
+		var out bytes.Buffer
+		c.Assert(RewriteVorbisCommentWith(bytes.NewReader(stream), &out, meta.VorbisComment.Data, opts), IsNil)
+		return out.Bytes()
+	}
+	c.Check(rewrite(a), DeepEquals, rewrite(b))
+
+	inPlace := func(stream []byte) []byte {
+		meta, err := ParseMetadata(bytes.NewReader(stream))
+		c.Assert(err, IsNil)
+		f := mkTempFLAC(c, stream)
+		defer f.Close()
+		c.Assert(WriteVorbisCommentInPlaceWith(f, meta.VorbisComment.Data, opts), IsNil)
+		out, err := os.ReadFile(f.Name())
+		c.Assert(err, IsNil)
+		return out
+	}
+	c.Check(inPlace(a), DeepEquals, inPlace(b))
+}
+
+func (s *S) TestWriteVendorOption(c *C) {
+	old := &VorbisCommentBlock{Vendor: "reference libFLAC 1.2.1 20070917", TotalComments: 1, Comments: []string{"TITLE=a"}}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, old.Encode()),
+		mkBlock(MetadataPadding, true, make([]byte, 64)))
+	opts := EncodeOptions{Vendor: "goflac-meta 1.0"}
+	vendor := func(b []byte) string {
+		meta, err := ParseMetadata(bytes.NewReader(b))
+		c.Assert(err, IsNil)
+		return meta.VorbisComment.Data.Vendor
+	}
+
+	// The block is unchanged, but the option still applies.
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	_, err = meta.WriteToWith(&out, opts)
+	c.Assert(err, IsNil)
+	c.Check(vendor(out.Bytes()), Equals, "goflac-meta 1.0")
+	c.Check(meta.VorbisComment.Data.Vendor, Equals, old.Vendor)
+
+	out.Reset()
+	c.Assert(RewriteVorbisCommentWith(bytes.NewReader(stream), &out, old, opts), IsNil)
+	c.Check(vendor(out.Bytes()), Equals, "goflac-meta 1.0")
+
+	f := mkTempFLAC(c, stream)
+	defer f.Close()
+	c.Assert(WriteVorbisCommentInPlaceWith(f, old, opts), IsNil)
+	b, err := os.ReadFile(f.Name())
+	c.Assert(err, IsNil)
+	c.Check(vendor(b), Equals, "goflac-meta 1.0")
+
+	// The zero value keeps the existing vendor.
+	out.Reset()
+	_, err = meta.WriteToWith(&out, EncodeOptions{})
+	c.Assert(err, IsNil)
+	c.Check(out.Bytes(), DeepEquals, stream)
+}
+
+func (s *S) TestRewriteVorbisComment(c *C) {
+	old := &VorbisCommentBlock{Vendor: "old", TotalComments: 1, Comments: []string{"TITLE=a"}}
+	audio := []byte{0xff, 0xf8, 0x69, 0x08}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, old.Encode()),
+		mkBlock(MetadataPadding, true, make([]byte, 16)))
+
+	vcb := &VorbisCommentBlock{Vendor: "new", TotalComments: 2, Comments: []string{"TITLE=b", "ARTIST=c"}}
+	var out bytes.Buffer
+	err := RewriteVorbisComment(bytes.NewReader(append(stream, audio...)), &out, vcb)
+	c.Assert(err, IsNil)
+
+	want := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, vcb.Encode()),
+		mkBlock(MetadataPadding, true, make([]byte, 16)))
+	c.Check(out.Bytes(), DeepEquals, append(want, audio...))
+}
+
+func (s *S) TestRewriteVorbisCommentAppends(c *C) {
+	stream := mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	vcb := &VorbisCommentBlock{Vendor: "new", TotalComments: 1, Comments: []string{"TITLE=b"}}
+
+	var out bytes.Buffer
+	c.Assert(RewriteVorbisComment(bytes.NewReader(stream), &out, vcb), IsNil)
+
+	meta, err := ParseMetadata(&out)
+	c.Assert(err, IsNil)
+	c.Check(meta.Streaminfo.Header.Last, Equals, false)
+	c.Check(meta.VorbisComment.Header.Last, Equals, true)
+	c.Check(meta.VorbisComment.Data, DeepEquals, vcb)
+}
+
+// mkTempFLAC writes stream to a new file and returns it opened for update.
+func mkTempFLAC(c *C, stream []byte) *os.File {
+	path := filepath.Join(c.MkDir(), "t.flac")
+	c.Assert(os.WriteFile(path, stream, 0666), IsNil)
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	c.Assert(err, IsNil)
+	return f
+}
+
+func (s *S) TestWriteVorbisCommentInPlace(c *C) {
+	old := &VorbisCommentBlock{Vendor: "old", TotalComments: 1, Comments: []string{"TITLE=a"}}
+	audio := []byte{0xff, 0xf8, 0x69, 0x08}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, old.Encode()),
+		mkBlock(MetadataPadding, true, make([]byte, 16)))
+	f := mkTempFLAC(c, append(stream, audio...))
+	defer f.Close()
+
+	for _, vcb := range []*VorbisCommentBlock{
+		{Vendor: "new", TotalComments: 2, Comments: []string{"TITLE=b", "ARTIST=c"}},
+		{Vendor: "v", TotalComments: 1, Comments: []string{"X="}},
+	} {
+		c.Assert(WriteVorbisCommentInPlace(f, vcb), IsNil)
+
+		_, err := f.Seek(0, io.SeekStart)
+		c.Assert(err, IsNil)
+		meta, err := ParseMetadata(f)
+		c.Assert(err, IsNil)
+		c.Check(meta.VorbisComment.Data, DeepEquals, vcb)
+		c.Check(meta.Padding.Header.Last, Equals, true)
+		c.Check(audioOffset(c, meta), Equals, int64(len(stream)))
+
+		rest, err := io.ReadAll(f)
+		c.Assert(err, IsNil)
+		c.Check(rest, DeepEquals, audio)
+	}
+}
+
+func (s *S) TestWriteVorbisCommentInPlaceNoRoom(c *C) {
+	old := &VorbisCommentBlock{Vendor: "old", TotalComments: 0, Comments: []string{}}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, old.Encode()),
+		mkBlock(MetadataPadding, true, make([]byte, 4)))
+	f := mkTempFLAC(c, stream)
+	defer f.Close()
+
+	vcb := &VorbisCommentBlock{Vendor: "old", TotalComments: 1, Comments: []string{"TITLE=a"}}
+	err := WriteVorbisCommentInPlace(f, vcb)
+	c.Check(err, ErrorMatches, "FATAL: VORBIS_COMMENT block of 22 bytes needs 7 more byte.* of padding: .*")
+	c.Check(errors.Is(err, ErrNoRoom), Equals, true)
+
+	b, err := os.ReadFile(f.Name())
+	c.Assert(err, IsNil)
+	c.Check(b, DeepEquals, stream)
+
+	f = mkTempFLAC(c, mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo())))
+	defer f.Close()
+	c.Check(errors.Is(WriteVorbisCommentInPlace(f, vcb), ErrNoRoom), Equals, true)
+}
+
+func (s *S) TestWriteVorbisCommentOgg(c *C) {
+	first := mkOggFLACHeader(2)
+	second := mkBlock(MetadataVorbisComment, false, (&VorbisCommentBlock{Vendor: "ogg", Comments: []string{}}).Encode())
+	third := mkBlock(MetadataPadding, true, make([]byte, 100))
+	var stream []byte
+	stream = append(stream, mkOggPage(7, first, len(first))...)
+	stream = append(stream, mkOggPage(7, second, len(second))...)
+	stream = append(stream, mkOggPage(7, third, len(third))...)
+	f := mkTempFLAC(c, stream)
+	defer f.Close()
+
+	vcb := &VorbisCommentBlock{Vendor: "ogg", TotalComments: 1, Comments: []string{"TITLE=a"}}
+	c.Check(WriteVorbisCommentInPlace(f, vcb), ErrorMatches, "FATAL: cannot edit the metadata of an Ogg FLAC file.*")
+	b, err := os.ReadFile(f.Name())
+	c.Assert(err, IsNil)
+	c.Check(b, DeepEquals, stream)
+
+	var out bytes.Buffer
+	c.Check(RewriteVorbisComment(bytes.NewReader(stream), &out, vcb), ErrorMatches, "FATAL: cannot edit the metadata of an Ogg FLAC file.*")
+	c.Check(out.Len(), Equals, 0)
+}
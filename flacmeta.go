@@ -12,23 +12,41 @@
 // for more details.
 
 // Package flac provides an API to process metadata from FLAC audio files.
+//
+// The package is imported as "github.com/justinruggles/goflac-meta". A
+// Metadata value is populated from any io.Reader positioned at the start of
+// a FLAC stream:
+//
+//	meta := new(flac.Metadata)
+//	if err := meta.Read(f); err != nil {
+//		// handle the error
+//	}
+//
+// The package never prints or exits on its own; every problem with the input
+// is reported through a returned error.
 package flac
 
 // TODO: make NewZZZ functions to create Header+Data blocks
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
-// METADATA_BLOCK_TYPES enumerates types of metadata blocks in a FLAC file.
+// MetadataBlockType enumerates types of metadata blocks in a FLAC file.
 type MetadataBlockType uint32
 
 const (
-	FlacSignature = "fLaC"
-
 	MetadataStreaminfo    MetadataBlockType = iota // 0
 	MetadataPadding                                // 1
 	MetadataApplication                            // 2
@@ -38,6 +56,14 @@ const (
 	MetadataPicture                                // 6
 	MetadataInvalid       MetadataBlockType = 127
 
+	FlacSignature = "fLaC"
+
+	// ID3v2Signature starts the ID3v2 tag some taggers wrongly prepend to a
+	// FLAC file. id3v2HeaderLen is the length of the tag header, and of the
+	// optional footer.
+	ID3v2Signature = "ID3"
+	id3v2HeaderLen = 10
+
 	// Metadata field sizes, in bits.
 	ApplicationIdLen = 32
 
@@ -54,11 +80,11 @@ const (
 	CuesheetTrackPreemphasisLen = 1
 	CuesheetTrackReservedLen    = CuesheetTrackTrackTypeLen + CuesheetTrackPreemphasisLen + 6 + 13*8
 	CuesheetTrackIndexPointsLen = 8
-	CuesheetTrackBlockLen       = (CuesheetTrackTrackOffsetLen +
+	// CuesheetTrackReservedLen already counts the track type and
+	// pre-emphasis bits, so they are not added again.
+	CuesheetTrackBlockLen = (CuesheetTrackTrackOffsetLen +
 		CuesheetTrackTrackNumberLen +
 		CuesheetTrackTrackISRCLen +
-		CuesheetTrackTrackTypeLen +
-		CuesheetTrackPreemphasisLen +
 		CuesheetTrackReservedLen +
 		CuesheetTrackIndexPointsLen)
 
@@ -93,7 +119,7 @@ const (
 	StreaminfoMaxFrameSizeLen  = 24
 	StreaminfoSampleRateLen    = 20
 	StreaminfoChannelCountLen  = 3
-	StreaminfoBitsPerSampleLen = 6
+	StreaminfoBitsPerSampleLen = 5
 	StreaminfoTotalSamplesLen  = 36
 	StreaminfoMD5Len           = 128
 
@@ -113,31 +139,189 @@ const (
 	StreaminfoBitsPerSampleMinimum = 4
 	StreaminfoBitsPerSampleMaximum = 1 << StreaminfoBitsPerSampleLen
 	StreaminfoTotalSamplesMaximum  = 1 << StreaminfoTotalSamplesLen
+
+	// SeekpointPlaceholder is the sample number of a placeholder seek point.
+	SeekpointPlaceholder = 0xFFFFFFFFFFFFFFFF
+
+	// MetadataBlockMaxLength is the largest block body the 24 bit length
+	// field of a metadata block header can describe.
+	MetadataBlockMaxLength = 1<<24 - 1
+)
+
+// ErrNotFLAC is returned, wrapped, when a stream does not begin with the FLAC
+// signature.
+var ErrNotFLAC = errors.New("not a FLAC stream")
+
+// fileSignatures are the magic bytes of formats often mistaken for FLAC, used
+// to say what a stream without the FLAC signature looks like instead.
+var fileSignatures = []struct {
+	magic  string
+	format string
+}{
+	{"ID3", "an ID3v2 tag, as on an MP3 file or a FLAC file with a prepended tag"},
+	{"\xFF\xFB", "MP3 audio"},
+	{"\xFF\xF3", "MP3 audio"},
+	{"\xFF\xF2", "MP3 audio"},
+	{"RIFF", "a RIFF (WAV) file"},
+	{"FORM", "an IFF (AIFF) file"},
+	{"OggS", "an Ogg file"},
+}
+
+// id3v2Length returns the length of the ID3v2 tag, including its header and
+// footer, whose 10 byte header starts h. ok is false if h does not start
+// with a valid ID3v2 header.
+func id3v2Length(h []byte) (n int64, ok bool) {
+	// Field Len  | Data
+	// -----------+--------------------------------------------------------
+	// 3 * 8      | The ASCII signature "ID3".
+	// 8          | Major version.
+	// 8          | Revision.
+	// 8          | Flags; 0x10 means a footer follows the tag.
+	// 4 * 8      | Tag size, excluding header and footer, as a 28 bit
+	//            | syncsafe integer: 7 bits in each byte, top bit clear.
+	if len(h) < id3v2HeaderLen || string(h[:3]) != ID3v2Signature {
+		return 0, false
+	}
+	for _, c := range h[6:10] {
+		if c&0x80 != 0 {
+			return 0, false
+		}
+		n = n<<7 | int64(c)
+	}
+	n += id3v2HeaderLen
+	if h[5]&0x10 != 0 {
+		n += id3v2HeaderLen
+	}
+	return n, true
+}
+
+// skipID3v2 reads past the ID3v2 tag in r, whose first len(h) bytes have
+// already been read into h, and returns the length of the tag.
+func skipID3v2(r io.Reader, h []byte) (int64, error) {
+	header := make([]byte, id3v2HeaderLen)
+	copy(header, h)
+	if _, err := io.ReadFull(r, header[len(h):]); err != nil {
+		return 0, fmt.Errorf("FATAL: error reading ID3v2 tag header: %w: %w", ErrTruncatedFile, err)
+	}
+	n, ok := id3v2Length(header)
+	if !ok {
+		return 0, fmt.Errorf("FATAL: invalid ID3v2 tag header: %w", ErrNotFLAC)
+	}
+	if _, err := io.CopyN(io.Discard, r, n-id3v2HeaderLen); err != nil {
+		return 0, fmt.Errorf("FATAL: error skipping %d byte ID3v2 tag: %w: %w", n, ErrTruncatedFile, err)
+	}
+	return n, nil
+}
+
+// sniffFormat returns a description of the format whose magic bytes start
+// b, or "" if none in fileSignatures match.
+func sniffFormat(b []byte) string {
+	for _, fs := range fileSignatures {
+		if strings.HasPrefix(string(b), fs.magic) {
+			return fs.format
+		}
+	}
+	return ""
+}
+
+// ErrTruncatedFile is returned, wrapped, when a stream ends before its
+// signature or before the header of a metadata block, as happens when a file
+// too short to hold a STREAMINFO block is read.
+var ErrTruncatedFile = errors.New("truncated FLAC file")
+
+// ErrTruncatedBlock is returned, wrapped, when a stream ends before the data
+// of a metadata block is complete.
+var ErrTruncatedBlock = errors.New("truncated metadata block")
+
+// ErrNoLastBlock is returned, wrapped, when the metadata of a stream ends,
+// at end of file or at the first audio frame, without a block having the
+// last-metadata-block flag set.
+var ErrNoLastBlock = errors.New("no last metadata block")
+
+// ParseError records the metadata block that could not be read: its index
+// in file order, its type, the offset of its header from the start of the
+// file and the underlying error.
+type ParseError struct {
+	Index  int
+	Type   MetadataBlockType
+	Offset int64
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("block #%d (%s) at offset %d: %s", e.Index, e.Type, e.Offset, e.Err)
+}
+
+func (e *ParseError) Unwrap() error { return e.Err }
+
+// ErrNoRoom is returned, wrapped, when an edit cannot be made in place
+// because the file lacks padding to absorb the change in size.
+var ErrNoRoom = errors.New("not enough padding to edit in place")
+
+// ErrBlockTooLarge is returned, wrapped, when a block body longer than
+// MetadataBlockMaxLength bytes is encoded, or found in an Ogg packet.
+var ErrBlockTooLarge = errors.New("metadata block too large")
+
+// ErrMissingStreamInfo is returned, wrapped, when the first metadata block
+// of a stream is not STREAMINFO, as the format requires.
+var ErrMissingStreamInfo = errors.New("STREAMINFO is not the first block")
+
+// ErrMetadataTooLarge is returned, wrapped, when the blocks of a stream add
+// up to more than the Metadata.MaxMetadataBytes limit.
+var ErrMetadataTooLarge = errors.New("metadata too large")
+
+// DefaultMaxMetadataBytes is the limit on the total size of the metadata
+// blocks that Read applies when Metadata.MaxMetadataBytes is 0.
+const DefaultMaxMetadataBytes = 64 << 20
+
+// APIC picture types, as stored in PictureBlock.PictureTypeId.
+const (
+	PictureOther = iota
+	PictureFileIcon
+	PictureOtherFileIcon
+	PictureCoverFront
+	PictureCoverBack
+	PictureLeafletPage
+	PictureMedia
+	PictureLeadArtist
+	PictureArtist
+	PictureConductor
+	PictureBand
+	PictureComposer
+	PictureLyricist
+	PictureRecordingLocation
+	PictureDuringRecording
+	PictureDuringPerformance
+	PictureScreenCapture
+	PictureBrightColouredFish
+	PictureIllustration
+	PictureBandLogotype
+	PicturePublisherLogotype
 )
 
 // PictureTypeMap enumerates the types of pictures in a PictureBlock.
 var PictureTypeMap = map[uint32]string{
-	0:  "Other",
-	1:  "File Icon",
-	2:  "Other File Icon",
-	3:  "Cover (front)",
-	4:  "Cover (back)",
-	5:  "Leaflet Page",
-	6:  "Media",
-	7:  "Lead Artist/Lead Performer/Soloist",
-	8:  "Artist/Performer",
-	9:  "Conductor",
-	10: "Band/Orchestra",
-	11: "Composer",
-	12: "Lyricist/Text Writer",
-	13: "Recording Location",
-	14: "During Recording",
-	15: "During Performance",
-	16: "Movie/Video Screen Capture",
-	17: "A Bright Coloured Fish",
-	18: "Illustration",
-	19: "Band/Artist Logotype",
-	20: "Publisher/Studio Logotype",
+	PictureOther:              "Other",
+	PictureFileIcon:           "File Icon",
+	PictureOtherFileIcon:      "Other File Icon",
+	PictureCoverFront:         "Cover (front)",
+	PictureCoverBack:          "Cover (back)",
+	PictureLeafletPage:        "Leaflet Page",
+	PictureMedia:              "Media",
+	PictureLeadArtist:         "Lead Artist/Lead Performer/Soloist",
+	PictureArtist:             "Artist/Performer",
+	PictureConductor:          "Conductor",
+	PictureBand:               "Band/Orchestra",
+	PictureComposer:           "Composer",
+	PictureLyricist:           "Lyricist/Text Writer",
+	PictureRecordingLocation:  "Recording Location",
+	PictureDuringRecording:    "During Recording",
+	PictureDuringPerformance:  "During Performance",
+	PictureScreenCapture:      "Movie/Video Screen Capture",
+	PictureBrightColouredFish: "A Bright Coloured Fish",
+	PictureIllustration:       "Illustration",
+	PictureBandLogotype:       "Band/Artist Logotype",
+	PicturePublisherLogotype:  "Publisher/Studio Logotype",
 }
 
 // LookupHeaderType returns a const representing a METADATA_BLOCK_TYPE or
@@ -192,6 +376,9 @@ func (mbt MetadataBlockType) String() string {
 	case MetadataPicture:
 		return "PICTURE"
 	}
+	if mbt < MetadataInvalid {
+		return "UNKNOWN"
+	}
 	return "INVALID"
 }
 
@@ -205,6 +392,9 @@ type ApplicationBlock struct {
 	Data []byte
 }
 
+// CuesheetBlock describes the track and index layout of the audio stream,
+// typically the table of contents of the CD it was ripped from.
+// Only one CuesheetBlock is allowed per file.
 type CuesheetBlock struct {
 	MediaCatalogNumber string
 	LeadinSamples      uint64
@@ -214,6 +404,7 @@ type CuesheetBlock struct {
 	CuesheetTracks []*CuesheetTrackBlock
 }
 
+// CuesheetTrackBlock describes a single track of a CuesheetBlock.
 type CuesheetTrackBlock struct {
 	TrackOffset uint64
 	TrackNumber uint8
@@ -225,6 +416,7 @@ type CuesheetTrackBlock struct {
 	CuesheetTrackIndexes []*CuesheetTrackIndexBlock
 }
 
+// CuesheetTrackIndexBlock describes an index point within a CuesheetTrackBlock.
 type CuesheetTrackIndexBlock struct {
 	SampleOffset uint64
 	IndexPoint   uint8
@@ -242,9 +434,29 @@ type MetadataBlockHeader struct {
 	SeekPoints uint16
 }
 
+// String renders the header the way metaflac lists it, one field per line:
+//
+//	type: 4 (VORBIS_COMMENT)
+//	is last: false
+//	length: 57
+func (mbh *MetadataBlockHeader) String() string {
+	return fmt.Sprintf("type: %d (%s)\nis last: %t\nlength: %d", uint32(mbh.Type), mbh.Type, mbh.Last, mbh.Length)
+}
+
+// PaddingBlock describes space reserved in the metadata for later edits, such
+// as growing a VorbisCommentBlock without rewriting the whole file. IsZero
+// reports whether every padding byte is zero, as the format requires.
+type PaddingBlock struct {
+	Length uint32
+	IsZero bool
+}
+
 // PictureBlock contains information and binary data about pictures that
 // are embedded in the FLAC file. Muitiple PictureBlocks are allow per file.
+// PictureTypeId is the ID3v2 APIC picture type and PictureType its name;
+// PictureBlob holds the raw image data.
 type PictureBlock struct {
+	PictureTypeId      uint32
 	PictureType        string
 	MimeType           string
 	PictureDescription string
@@ -253,7 +465,7 @@ type PictureBlock struct {
 	ColorDepth         uint32
 	NumColors          uint32
 	Length             uint32
-	PictureBlob        string
+	PictureBlob        []byte
 }
 
 // SeekpointBlock contains locations within the FLAC file that allow
@@ -264,8 +476,15 @@ type SeekpointBlock struct {
 	FrameSamples uint16
 }
 
+// IsPlaceholder reports whether spb is a placeholder point, reserving room in
+// the seektable for a seek point to be filled in later.
+func (spb *SeekpointBlock) IsPlaceholder() bool {
+	return spb.SampleNumber == SeekpointPlaceholder
+}
+
 // StreaminfoBlock contains information about the audio stream.
 // Only one StreaminfoBlock is allowed per file. It is also the only required block.
+// MD5 is the signature of the unencoded audio.
 type StreaminfoBlock struct {
 	MinBlockSize  uint16
 	MaxBlockSize  uint16
@@ -275,9 +494,76 @@ type StreaminfoBlock struct {
 	Channels      uint8
 	BitsPerSample uint8
 	TotalSamples  uint64
-	MD5Signature  string
+	// Deprecated: MD5Signature is the hex form of MD5; use MD5.String.
+	MD5Signature string
+	MD5          MD5Sum
+}
+
+// MD5Sum is the MD5 signature of the unencoded audio stored in a
+// STREAMINFO block.
+type MD5Sum [16]byte
+
+// String returns the signature as 32 lower-case hex digits.
+func (sum MD5Sum) String() string {
+	return hex.EncodeToString(sum[:])
+}
+
+// MarshalText implements encoding.TextMarshaler, giving the same lower-case
+// hex as String.
+func (sum MD5Sum) MarshalText() ([]byte, error) {
+	return []byte(sum.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler. It accepts 32 hex
+// digits in either case.
+func (sum *MD5Sum) UnmarshalText(text []byte) error {
+	if len(text) != 2*len(sum) {
+		return fmt.Errorf("FATAL: MD5 signature must be %d hex digits, got %d.", 2*len(sum), len(text))
+	}
+	var b MD5Sum
+	if _, err := hex.Decode(b[:], text); err != nil {
+		return fmt.Errorf("FATAL: invalid MD5 signature %q: %w", text, err)
+	}
+	*sum = b
+	return nil
 }
 
+// Field names of Vorbis comments, for use with VorbisCommentBlock.Get, Set
+// and friends. The first group is from the Vorbis comment specification,
+// the second is in common use by taggers, and the last holds the ReplayGain
+// fields. Field names are case-insensitive; these are the upper-case forms
+// taggers write.
+const (
+	CommentTitle        = "TITLE"
+	CommentVersion      = "VERSION"
+	CommentAlbum        = "ALBUM"
+	CommentTrackNumber  = "TRACKNUMBER"
+	CommentArtist       = "ARTIST"
+	CommentPerformer    = "PERFORMER"
+	CommentCopyright    = "COPYRIGHT"
+	CommentLicense      = "LICENSE"
+	CommentOrganization = "ORGANIZATION"
+	CommentDescription  = "DESCRIPTION"
+	CommentGenre        = "GENRE"
+	CommentDate         = "DATE"
+	CommentLocation     = "LOCATION"
+	CommentContact      = "CONTACT"
+	CommentISRC         = "ISRC"
+
+	CommentAlbumArtist = "ALBUMARTIST"
+	CommentTrackTotal  = "TRACKTOTAL"
+	CommentDiscNumber  = "DISCNUMBER"
+	CommentDiscTotal   = "DISCTOTAL"
+	CommentComposer    = "COMPOSER"
+	CommentComment     = "COMMENT"
+
+	CommentReplayGainTrackGain         = "REPLAYGAIN_TRACK_GAIN"
+	CommentReplayGainTrackPeak         = "REPLAYGAIN_TRACK_PEAK"
+	CommentReplayGainAlbumGain         = "REPLAYGAIN_ALBUM_GAIN"
+	CommentReplayGainAlbumPeak         = "REPLAYGAIN_ALBUM_PEAK"
+	CommentReplayGainReferenceLoudness = "REPLAYGAIN_REFERENCE_LOUDNESS"
+)
+
 // VorbisCommentBlock contains general information about the song/audio stream.
 // Common fields are Artist, Song Title and Album.
 // Only one VorbisCommentBlock is allowed per file.
@@ -309,7 +595,7 @@ type Cuesheet struct {
 // Padding is a full Padding block (header + data).
 type Padding struct {
 	Header      *MetadataBlockHeader
-	Data        []byte
+	Data        *PaddingBlock
 	IsPopulated bool
 }
 
@@ -341,6 +627,24 @@ type VorbisComment struct {
 	IsPopulated bool
 }
 
+// Block is a metadata block in the order it appeared in the FLAC file. Raw
+// holds the block data as read, without its header. Recognized blocks are
+// also decoded into the typed fields of Metadata, and WriteTo writes Raw
+// for them as long as those fields still decode from it unchanged; blocks
+// of types this package does not recognize only have Raw. Offset is the
+// position of the block header from the start of the file, counting the
+// "fLaC" signature; for a block read from Ogg FLAC, see Metadata.Ogg.
+type Block struct {
+	Header *MetadataBlockHeader
+	Offset int64
+	Raw    []byte
+}
+
+// Len returns the size of the block in the file, including its header.
+func (b *Block) Len() int64 {
+	return MetadataBlockHeaderLen/8 + int64(b.Header.Length)
+}
+
 // Metadata represents all metadata present in a FLAC file.
 type Metadata struct {
 	Streaminfo
@@ -350,11 +654,53 @@ type Metadata struct {
 	Padding
 	Seektable
 	Cuesheet
+	Blocks []*Block
+
+	// Deprecated: TotalBlocks is never set; use BlockCount.
 	TotalBlocks uint8
+
+	// VorbisComments holds every VORBIS_COMMENT block in file order. The
+	// format allows only one, which VorbisComment also holds, but some files
+	// have more and their data is kept here; see PrimaryComments.
+	VorbisComments []*VorbisComment
+
+	// ID3v2Length is the length of an ID3v2 tag found before the "fLaC"
+	// signature, or 0 if there was none. Block offsets count from the start
+	// of the file, so they include it.
+	ID3v2Length int64
+
+	// Ogg is true if the metadata was read from an Ogg FLAC stream. Block
+	// offsets and MetadataLength then describe the same blocks in a native
+	// FLAC file, not positions in the Ogg file, and AudioOffset, AudioReader
+	// and AverageBitrate report that they cannot locate the audio.
+	Ogg bool
+
+	// MaxMetadataBytes limits the total size of the metadata blocks read,
+	// headers included, so that a file claiming huge blocks cannot exhaust
+	// memory; Read fails with ErrMetadataTooLarge, without reading the data
+	// of the block that would go over it. 0 means
+	// DefaultMaxMetadataBytes and a negative value means no limit. No single
+	// block can be longer than MetadataBlockMaxLength in any case.
+	MaxMetadataBytes int64
+
+	// Strict makes Read fail on a block whose type the FLAC format does not
+	// define, instead of keeping its data in Block.Raw, and on a STREAMINFO
+	// block that fails StreaminfoBlock.Validate. Block type 127 is always an
+	// error.
+	Strict bool
 }
 
 // Begin ParseX functions.
 
+// readField returns the next n bytes of buf, or an error naming the field if
+// fewer than n bytes remain.
+func readField(buf *bytes.Buffer, n int, name string) ([]byte, error) {
+	if n < 0 || buf.Len() < n {
+		return nil, fmt.Errorf("FATAL: error reading %s field. Expected %d byte(s), got %d.", name, n, buf.Len())
+	}
+	return buf.Next(n), nil
+}
+
 // Parse parses the bits of a FLAC Application block.
 func (ab *ApplicationBlock) Parse(block []byte) error {
 	// http://flac.sourceforge.net/format.html#metadata_block_application
@@ -366,14 +712,29 @@ func (ab *ApplicationBlock) Parse(block []byte) error {
 
 	buf := bytes.NewBuffer(block)
 
-	ab.Id = binary.BigEndian.Uint32(buf.Next(ApplicationIdLen))
-	if buf.Len()%8 != 0 {
-		return fmt.Errorf("Malformed ApplictionBlock: the data field length must be a mulitple of 8.")
+	id, err := readField(buf, ApplicationIdLen/8, "Id")
+	if err != nil {
+		return err
 	}
+	ab.Id = binary.BigEndian.Uint32(id)
 	ab.Data = buf.Bytes()
 	return nil
 }
 
+// IdString returns the application ID as the four ASCII characters it was
+// registered under, e.g. "riff". ok is false if any byte of the ID is not
+// printable ASCII.
+func (ab *ApplicationBlock) IdString() (id string, ok bool) {
+	b := make([]byte, ApplicationIdLen/8)
+	binary.BigEndian.PutUint32(b, ab.Id)
+	for _, c := range b {
+		if c < 0x20 || c > 0x7e {
+			return "", false
+		}
+	}
+	return string(b), true
+}
+
 // Parse parses the bits of a FLAC Cue Sheet block.
 func (cb *CuesheetBlock) Parse(block []byte) error {
 	// http://flac.sourceforge.net/format.html#metadata_block_cuesheet
@@ -408,32 +769,63 @@ func (cb *CuesheetBlock) Parse(block []byte) error {
 	const trackType = 0x01
 	buf := bytes.NewBuffer(block)
 
-	cb.MediaCatalogNumber = string(buf.Next(CuesheetMediaCatalogNumberLen / 8))
-	cb.LeadinSamples = binary.BigEndian.Uint64(buf.Next(CuesheetLeadinSamplesLen / 8))
+	f, err := readField(buf, CuesheetMediaCatalogNumberLen/8, "MediaCatalogNumber")
+	if err != nil {
+		return err
+	}
+	cb.MediaCatalogNumber = string(f)
 
-	res := buf.Next(CuesheetReservedLen / 8)
+	if f, err = readField(buf, CuesheetLeadinSamplesLen/8, "LeadinSamples"); err != nil {
+		return err
+	}
+	cb.LeadinSamples = binary.BigEndian.Uint64(f)
 
-	if res[0]>>7&trackType == 1 {
+	if f, err = readField(buf, CuesheetReservedLen/8, "Reserved"); err != nil {
+		return err
+	}
+	if f[0]>>7&trackType == 1 {
 		cb.IsCompactDisc = true
 	}
 
-	cb.TotalTracks = uint8(buf.Next(CuesheetTotalTracksLen / 8)[0])
+	if f, err = readField(buf, CuesheetTotalTracksLen/8, "TotalTracks"); err != nil {
+		return err
+	}
+	cb.TotalTracks = uint8(f[0])
 
 	if cb.TotalTracks < 1 {
 		return fmt.Errorf("FATAL: CuesheetBlock.TotalTracks value must be greater than >= 1.")
 	}
 
 	for i := 0; i < int(cb.TotalTracks); i++ {
-		cb.ParseTrack(buf.Next(CuesheetTrackBlockLen / 8))
-		for j := 0; j < int(cb.CuesheetTracks[i].IndexPoints); j++ {
-			cb.CuesheetTracks[i].ParseIndex(buf.Next(CuesheetTrackIndexBlockLen / 8))
+		if f, err = readField(buf, CuesheetTrackBlockLen/8, "CuesheetTrack"); err != nil {
+			return err
+		}
+		if err = cb.ParseTrack(f); err != nil {
+			return err
+		}
+
+		ctb := cb.CuesheetTracks[i]
+		for j := 0; j < int(ctb.IndexPoints); j++ {
+			if f, err = readField(buf, CuesheetTrackIndexBlockLen/8, "CuesheetTrackIndex"); err != nil {
+				return err
+			}
+			if err = ctb.ParseIndex(f); err != nil {
+				return err
+			}
+
+			// Index offsets only need to fall on CD frame boundaries for CD-DA.
+			cti := ctb.CuesheetTrackIndexes[j]
+			if cb.IsCompactDisc && cti.SampleOffset%588 != 0 {
+				return fmt.Errorf("Invalid value '%d' for Cuesheet Track Index Sample Offset: must be divisible by 588.", cti.SampleOffset)
+			}
 		}
 	}
 
 	return nil
 }
 
-// Parse parses the bits of a FLAC Cue Sheet Track block.
+// ParseTrack parses the bits of a FLAC Cue Sheet Track block and appends the
+// track to cb.CuesheetTracks.
 func (cb *CuesheetBlock) ParseTrack(block []byte) error {
 	// http://flac.sourceforge.net/format.html#cuesheet_track
 	// Field Len  | Data
@@ -470,8 +862,10 @@ func (cb *CuesheetBlock) ParseTrack(block []byte) error {
 	//            | [2] http://en.wikipedia.org/wiki/International_Standard_Recording_Code
 	//            | [3] http://www.chipchapin.com/CDMedia/cdda9.php3
 
-	// TODO Implement error checking here.
 	const trackType = 0x01
+	if len(block) < CuesheetTrackBlockLen/8 {
+		return fmt.Errorf("FATAL: Cuesheet track is %d byte(s), expected %d.", len(block), CuesheetTrackBlockLen/8)
+	}
 	buf := bytes.NewBuffer(block)
 
 	ctb := new(CuesheetTrackBlock)
@@ -501,7 +895,8 @@ func (cb *CuesheetBlock) ParseTrack(block []byte) error {
 	return nil
 }
 
-// Parse parses the bits of a Cue Sheet Track Index block.
+// ParseIndex parses the bits of a FLAC Cue Sheet Track Index block and
+// appends the index point to ctb.CuesheetTrackIndexes.
 func (ctb *CuesheetTrackBlock) ParseIndex(block []byte) error {
 	// http://flac.sourceforge.net/format.html#cuesheet_track_index
 	// Field Len  | Data
@@ -519,14 +914,14 @@ func (ctb *CuesheetTrackBlock) ParseIndex(block []byte) error {
 	//            |
 	// 3 * 8      | Reserved. All bits must be set to zero.
 
+	if len(block) < CuesheetTrackIndexBlockLen/8 {
+		return fmt.Errorf("FATAL: Cuesheet track index is %d byte(s), expected %d.", len(block), CuesheetTrackIndexBlockLen/8)
+	}
 	buf := bytes.NewBuffer(block)
 
 	cti := new(CuesheetTrackIndexBlock)
 
 	cti.SampleOffset = binary.BigEndian.Uint64(buf.Next(CuesheetTrackIndexSampleOffsetLen / 8))
-	if cti.SampleOffset%588 != 0 {
-		return fmt.Errorf("Invalid value '%d' for Cuesheet Track Index Sample Offset: must be divisible by 588.", cti.SampleOffset)
-	}
 
 	cti.IndexPoint = uint8(buf.Next(CuesheetTrackIndexPointLen / 8)[0])
 	ctb.CuesheetTrackIndexes = append(ctb.CuesheetTrackIndexes, cti)
@@ -547,24 +942,24 @@ func (mbh *MetadataBlockHeader) Parse(block []byte) error {
 	// 24         | Length (in bytes) of metadata to follow (does not include
 	//            | the size of the METADATA_BLOCK_HEADER)
 
-	const (
-		lastBlock = 0x80000000
-		blockType = 0x7F000000
-		blockLen  = 0x00FFFFFF
-	)
-
-	bits := binary.BigEndian.Uint32(block)
-
-	if (lastBlock&bits)>>31 == 1 {
-		mbh.Last = true
+	br := &bitReader{b: block}
+	mbh.Last = br.read(1, "Last-metadata-block flag") == 1
+	bt := uint32(br.read(7, "BLOCK_TYPE"))
+	length := uint32(br.read(24, "Length"))
+	if br.err != nil {
+		return br.err
 	}
 
-	bt := blockType & bits >> 24
 	mbh.Type = LookupHeaderType(bt)
 	if mbh.Type == MetadataInvalid {
-		return fmt.Errorf("FATAL: Encountered an invalid or unknown block type: %d.", bt)
+		if bt == uint32(MetadataInvalid) {
+			return fmt.Errorf("FATAL: Encountered an invalid block type: %d.", bt)
+		}
+		// Reserved block types are kept so the block can be skipped and its
+		// raw data retained.
+		mbh.Type = MetadataBlockType(bt)
 	}
-	mbh.Length = blockLen & bits
+	mbh.Length = length
 
 	if mbh.Type == MetadataSeektable {
 		if mbh.Length%(SeekpointBlockLen/8) != 0 {
@@ -575,6 +970,24 @@ func (mbh *MetadataBlockHeader) Parse(block []byte) error {
 	return nil
 }
 
+// Parse records the length of a FLAC padding block and whether it is zeroed.
+func (pb *PaddingBlock) Parse(block []byte) error {
+	// http://flac.sourceforge.net/format.html#metadata_block_padding
+	// Field Len  | Data
+	// -----------+--------------------------------------------------------
+	// n          | n '0' bits (n must be a multiple of 8)
+
+	pb.Length = uint32(len(block))
+	pb.IsZero = true
+	for _, b := range block {
+		if b != 0 {
+			pb.IsZero = false
+			break
+		}
+	}
+	return nil
+}
+
 // Parse parses the bits of a FLAC picture block.
 func (pb *PictureBlock) Parse(block []byte) error {
 	// http://flac.sourceforge.net/format.html#metadata_block_picture
@@ -605,27 +1018,52 @@ func (pb *PictureBlock) Parse(block []byte) error {
 	//            |
 	// n * 8      | The binary picture data.
 
-	// TODO: Add error checking here.
 	buf := bytes.NewBuffer(block)
 
-	pb.PictureType = LookupPictureType(binary.BigEndian.Uint32(buf.Next(PictureTypeLen / 8)))
+	f, err := readField(buf, PictureTypeLen/8, "PictureType")
+	if err != nil {
+		return err
+	}
+	pb.PictureTypeId = binary.BigEndian.Uint32(f)
+	pb.PictureType = LookupPictureType(pb.PictureTypeId)
 
-	len := binary.BigEndian.Uint32(buf.Next(PictureMimeLengthLen / 8))
-	pb.MimeType = string(buf.Next(int(len)))
+	if f, err = readField(buf, PictureMimeLengthLen/8, "MimeLength"); err != nil {
+		return err
+	}
+	if f, err = readField(buf, int(binary.BigEndian.Uint32(f)), "MimeType"); err != nil {
+		return err
+	}
+	pb.MimeType = string(f)
 
-	len = binary.BigEndian.Uint32(buf.Next(PictureDescriptionLengthLen / 8))
-	if len > 0 {
-		pb.PictureDescription = string(buf.Next(int(len)))
-	} else {
-		pb.PictureDescription = ""
+	if f, err = readField(buf, PictureDescriptionLengthLen/8, "DescriptionLength"); err != nil {
+		return err
+	}
+	if f, err = readField(buf, int(binary.BigEndian.Uint32(f)), "PictureDescription"); err != nil {
+		return err
+	}
+	pb.PictureDescription = string(f)
+
+	fields := []struct {
+		v    *uint32
+		n    int
+		name string
+	}{
+		{&pb.Width, PictureWidthLen / 8, "Width"},
+		{&pb.Height, PictureHeightLen / 8, "Height"},
+		{&pb.ColorDepth, PictureColorDepthLen / 8, "ColorDepth"},
+		{&pb.NumColors, PictureNumberOfColorsLen / 8, "NumColors"},
+		{&pb.Length, PictureLengthLen / 8, "Length"},
+	}
+	for _, fld := range fields {
+		if f, err = readField(buf, fld.n, fld.name); err != nil {
+			return err
+		}
+		*fld.v = binary.BigEndian.Uint32(f)
 	}
-	pb.Width = binary.BigEndian.Uint32(buf.Next(PictureWidthLen / 8))
-	pb.Height = binary.BigEndian.Uint32(buf.Next(PictureHeightLen / 8))
-	pb.ColorDepth = binary.BigEndian.Uint32(buf.Next(PictureColorDepthLen / 8))
-	pb.NumColors = binary.BigEndian.Uint32(buf.Next(PictureNumberOfColorsLen / 8))
-	pb.Length = binary.BigEndian.Uint32(buf.Next(PictureLengthLen / 8))
-	pb.PictureBlob = hex.Dump(buf.Next(int(pb.Length)))
 
+	if pb.PictureBlob, err = readField(buf, int(pb.Length), "PictureBlob"); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -650,12 +1088,13 @@ func (stb *Seektable) Parse(block []byte) error {
 	//  - The previous two notes imply that there may be any number of placeholder points,
 	//    but they must all occur at the end of the table.
 
-	// TODO: Add error checking here.
 	buf := bytes.NewBuffer(block)
 
 	for i := 0; buf.Len() > 0; i++ {
 		spb := new(SeekpointBlock)
-		binary.Read(buf, binary.BigEndian, spb)
+		if err := binary.Read(buf, binary.BigEndian, spb); err != nil {
+			return fmt.Errorf("FATAL: error reading seek point %d: %s", i, err)
+		}
 
 		// These got replaced by binary.Read
 		//spb.SampleNumber = binary.BigEndian.Uint64(buf.Next(SeekpointSampleLen / 8))
@@ -667,6 +1106,66 @@ func (stb *Seektable) Parse(block []byte) error {
 	return nil
 }
 
+// SeekPointForSample returns the seek point with the highest sample number
+// not after sample, ignoring placeholder points. Its Offset is relative to
+// the first audio frame; see Metadata.AudioOffset. ok is false if every
+// seek point is past sample.
+func (stb *Seektable) SeekPointForSample(sample uint64) (spb *SeekpointBlock, ok bool) {
+	for _, p := range stb.Data {
+		if p.IsPlaceholder() || p.SampleNumber > sample {
+			continue
+		}
+		if spb == nil || p.SampleNumber > spb.SampleNumber {
+			spb = p
+		}
+	}
+	return spb, spb != nil
+}
+
+// SeekpointTimed is a seek point with its sample number as a time; see
+// Seektable.WithTimes.
+type SeekpointTimed struct {
+	*SeekpointBlock
+
+	// Time is the time of SampleNumber as HH:MM:SS.mmm, rounded to the
+	// millisecond, "placeholder" for a placeholder point, or "unknown" if
+	// the sample rate is 0.
+	Time string
+}
+
+// WithTimes returns the seek points of stb in order, each with the time of
+// its sample number at sampleRate, normally that of STREAMINFO.
+func (stb *Seektable) WithTimes(sampleRate uint32) []SeekpointTimed {
+	points := make([]SeekpointTimed, len(stb.Data))
+	for i, spb := range stb.Data {
+		points[i].SeekpointBlock = spb
+		switch {
+		case spb.IsPlaceholder():
+			points[i].Time = "placeholder"
+		case sampleRate == 0:
+			points[i].Time = "unknown"
+		default:
+			points[i].Time = FormatTimestamp(sampleTime(spb.SampleNumber, sampleRate))
+		}
+	}
+	return points
+}
+
+// sampleTime returns the time of sample number n at rate, which must not be
+// 0, without overflowing for any 36 bit sample number.
+func sampleTime(n uint64, rate uint32) time.Duration {
+	r := uint64(rate)
+	secs, rem := n/r, n%r
+	return time.Duration(secs)*time.Second + time.Duration(rem*uint64(time.Second)/r)
+}
+
+// FormatTimestamp formats d as HH:MM:SS.mmm, rounded to the millisecond, as
+// the Time of a seek point is.
+func FormatTimestamp(d time.Duration) string {
+	ms := d.Round(time.Millisecond).Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
 // Parse parses the bits of a FLAC streaminfo block.
 func (sib *StreaminfoBlock) Parse(block []byte) error {
 	// http://flac.sourceforge.net/format.html#metadata_block_streaminfo
@@ -689,62 +1188,160 @@ func (sib *StreaminfoBlock) Parse(block []byte) error {
 	// 36         | Total number of samples in the stream. 0 == Implied Unknown
 	//            |
 	// 128        | MD5 signature of the unencoded audio data.
-	// --------------------------------------------------------------------
-	// In order to keep everything on powers-of-2 boundaries, reads from the
-	// block are grouped thus:
-	//
-	// 	MinBlockSize = 16 bits
-	// 	MaxBlockSize + minFrameSize + maxFrameSize = 64 bits
-	// 	SampleRate + channels + bitsPerSample + TotalSamples = 64 bits
-	// 	md5Signature = 128 bits
-
-	const (
-		minFSMask       = 0xFFFFFFFFFFFFFFFF
-		maxFSMask       = 0xFFFFFF
-		sampRateMask    = 0xFFFFF00000000000
-		bitsPerSampMask = 0x1F000000000
-		chMask          = 0xE0000000000
-		totSampMask     = 0xFFFFFFFFF
-	)
-	var bits uint64
-
-	buf := bytes.NewBuffer(block)
 
-	mbs := buf.Next(StreaminfoMinBlockSizeLen / 8)
-	if len(mbs) != StreaminfoMinBlockSizeLen/8 {
-		return fmt.Errorf("FATAL: error reading MinBlockSize field. Expected %d byte(s), got %d.", StreaminfoMinBlockSizeLen/8, len(mbs))
+	br := &bitReader{b: block}
+	sib.MinBlockSize = uint16(br.read(16, "MinBlockSize"))
+	sib.MaxBlockSize = uint16(br.read(16, "MaxBlockSize"))
+	sib.MinFrameSize = uint32(br.read(24, "MinFrameSize"))
+	sib.MaxFrameSize = uint32(br.read(24, "MaxFrameSize"))
+	sib.SampleRate = uint32(br.read(20, "SampleRate"))
+	sib.Channels = uint8(br.read(3, "Channels")) + 1
+	sib.BitsPerSample = uint8(br.read(5, "BitsPerSample")) + 1
+	sib.TotalSamples = br.read(36, "TotalSamples")
+	sig := br.bytes(StreaminfoMD5Len/8, "MD5Signature")
+	if br.err != nil {
+		return br.err
 	}
-	sib.MinBlockSize = binary.BigEndian.Uint16(mbs)
+	copy(sib.MD5[:], sig)
+	sib.MD5Signature = sib.MD5.String()
+
+	return sib.checkParsed()
+}
+
+// checkParsed makes the checks of the block and sample sizes and rate that
+// Parse has always made. Validate makes these and the rest; it is run on
+// read only when Metadata.Strict is set, so that files with other
+// inconsistencies still load.
+func (sib *StreaminfoBlock) checkParsed() error {
 	if sib.MinBlockSize > 0 && sib.MinBlockSize < 16 {
 		return fmt.Errorf("FATAL: invalid MinBlockSize '%d'. Must be >= 16.", sib.MinBlockSize)
 	}
+	if sib.MaxBlockSize < 16 {
+		return fmt.Errorf("FATAL: invalid MaxBlockSize '%d'. Must be >= 16.", sib.MaxBlockSize)
+	}
+	if sib.SampleRate == 0 || sib.SampleRate >= 655350 {
+		return fmt.Errorf("FATAL: invalid SampleRate: %d. Must be > 0 and < 655350.", sib.SampleRate)
+	}
+	return nil
+}
 
-	bfsLen := (StreaminfoMaxBlockSizeLen + StreaminfoMinFrameSizeLen + StreaminfoMaxFrameSizeLen) / 8
+// String renders the StreaminfoBlock the way metaflac lists it, one field per
+// line.
+func (sib *StreaminfoBlock) String() string {
+	return fmt.Sprintf("minimum blocksize: %d samples\n"+
+		"maximum blocksize: %d samples\n"+
+		"minimum framesize: %d bytes\n"+
+		"maximum framesize: %d bytes\n"+
+		"sample_rate: %d Hz\n"+
+		"channels: %d\n"+
+		"bits-per-sample: %d\n"+
+		"total samples: %d\n"+
+		"MD5 signature: %s",
+		sib.MinBlockSize, sib.MaxBlockSize, sib.MinFrameSize, sib.MaxFrameSize,
+		sib.SampleRate, sib.Channels, sib.BitsPerSample, sib.TotalSamples, sib.MD5)
+}
 
-	bits = binary.BigEndian.Uint64(buf.Next(bfsLen))
-	sib.MaxBlockSize = uint16((minFSMask & bits) >> 48)
-	if sib.MaxBlockSize < 16 {
-		return fmt.Errorf("FATAL: invalid MaxBlockSize '%d'. Must be > 16.", sib.MaxBlockSize)
+// channelLayouts are the channel layouts the FLAC format assigns to each
+// channel count, with the channels in the order they are coded.
+var channelLayouts = [...]string{
+	1: "mono",
+	2: "stereo (left, right)",
+	3: "3.0 (left, right, center)",
+	4: "quad (front left, front right, back left, back right)",
+	5: "5.0 (front left, front right, front center, back left, back right)",
+	6: "5.1 (front left, front right, front center, LFE, back left, back right)",
+	7: "6.1 (front left, front right, front center, LFE, back center, side left, side right)",
+	8: "7.1 (front left, front right, front center, LFE, back left, back right, side left, side right)",
+}
+
+// ChannelLayout returns the name of the channel layout of the stream, such
+// as "5.1", followed by its channels in coded order. It is "unknown" for a
+// channel count outside 1 to 8.
+func (sib *StreaminfoBlock) ChannelLayout() string {
+	if sib.Channels < 1 || int(sib.Channels) >= len(channelLayouts) {
+		return "unknown"
 	}
-	sib.MinFrameSize = uint32((minFSMask & bits) >> 24)
-	sib.MaxFrameSize = uint32(maxFSMask & bits)
+	return channelLayouts[sib.Channels]
+}
 
-	bits = binary.BigEndian.Uint64(buf.Next((StreaminfoSampleRateLen +
-		StreaminfoChannelCountLen +
-		StreaminfoBitsPerSampleLen +
-		StreaminfoTotalSamplesLen) / 8))
+// IsFixedBlockSize reports whether MinBlockSize equals MaxBlockSize, which
+// strongly implies the stream uses a fixed block size. It is an inference
+// from STREAMINFO, not a guarantee: the blocking strategy is coded in each
+// frame header, as FrameHeader.VariableBlockSize, and a variable block size
+// stream may happen to use one size throughout.
+func (sib *StreaminfoBlock) IsFixedBlockSize() bool {
+	return sib.MinBlockSize == sib.MaxBlockSize
+}
 
-	sib.SampleRate = uint32((sampRateMask & bits) >> 44)
-	if sib.SampleRate == 0 || sib.SampleRate >= 655350 {
-		return fmt.Errorf("FATAL: invalid SampleRate: %d. Must be > 0 and < 655350.", sib.SampleRate)
+// IsHighResolution reports whether the stream exceeds CD quality in either
+// resolution or rate: more than 16 bits per sample, or a sample rate above
+// 48000 Hz. 44.1 and 48 kHz at 16 bits are the CD and DAT rates, so a
+// 24 bit 44.1 kHz stream is high resolution, and so is a 16 bit 96 kHz one.
+func (sib *StreaminfoBlock) IsHighResolution() bool {
+	return sib.BitsPerSample > 16 || sib.SampleRate > 48000
+}
+
+// DecodedSize returns the size in bytes of the decoded PCM audio, without
+// any WAV or other header. Each sample is rounded up to whole bytes, as WAV
+// stores it, so 12 bit samples take 2 bytes and 20 bit samples 3. ok is
+// false if TotalSamples is 0, meaning the length is unknown.
+func (sib *StreaminfoBlock) DecodedSize() (n int64, ok bool) {
+	if sib.TotalSamples == 0 {
+		return 0, false
+	}
+	sampleBytes := (int64(sib.BitsPerSample) + 7) / 8
+	return int64(sib.TotalSamples) * int64(sib.Channels) * sampleBytes, true
+}
+
+// Duration returns the playback length of the stream. A TotalSamples of 0
+// means the length is unknown, as for a live capture, and ok is false.
+func (sib *StreaminfoBlock) Duration() (d time.Duration, ok bool) {
+	if sib.TotalSamples == 0 || sib.SampleRate == 0 {
+		return 0, false
 	}
-	sib.Channels = uint8((chMask&bits)>>41) + 1
-	sib.BitsPerSample = uint8((bitsPerSampMask&bits)>>36) + 1
-	sib.TotalSamples = bits & totSampMask
+	return sampleTime(sib.TotalSamples, sib.SampleRate), true
+}
+
+// HasMD5 reports whether the encoder stored an MD5 signature. An all-zero
+// signature means the MD5 of the audio is unknown.
+func (sib *StreaminfoBlock) HasMD5() bool {
+	return sib.MD5 != MD5Sum{}
+}
 
-	sig := buf.Next(StreaminfoMD5Len / 8)
-	sib.MD5Signature = fmt.Sprintf("%x", sig)
+// MD5Matches reports whether sum, the MD5 of the decoded audio samples, is
+// the signature stored in the StreaminfoBlock. It is always false when the
+// signature is unknown; see HasMD5.
+func (sib *StreaminfoBlock) MD5Matches(sum []byte) bool {
+	return sib.HasMD5() && bytes.Equal(sib.MD5[:], sum)
+}
 
+// Validate checks that the fields of a StreaminfoBlock are within the bounds
+// allowed by the FLAC format, so that a corrupt block is reported instead of
+// yielding nonsensical values. Parse makes only some of these checks; see
+// Metadata.Strict.
+func (sib *StreaminfoBlock) Validate() error {
+	if err := sib.checkParsed(); err != nil {
+		return err
+	}
+	if sib.MinBlockSize > sib.MaxBlockSize {
+		return fmt.Errorf("FATAL: MinBlockSize '%d' is larger than MaxBlockSize '%d'.", sib.MinBlockSize, sib.MaxBlockSize)
+	}
+	if sib.MinFrameSize >= StreaminfoMaxFrameSizeMaximum || sib.MaxFrameSize >= StreaminfoMaxFrameSizeMaximum {
+		return fmt.Errorf("FATAL: invalid frame size range %d-%d. Must fit in %d bits.", sib.MinFrameSize, sib.MaxFrameSize, StreaminfoMaxFrameSizeLen)
+	}
+	// A frame size of 0 means the value is unknown.
+	if sib.MinFrameSize > 0 && sib.MaxFrameSize > 0 && sib.MinFrameSize > sib.MaxFrameSize {
+		return fmt.Errorf("FATAL: MinFrameSize '%d' is larger than MaxFrameSize '%d'.", sib.MinFrameSize, sib.MaxFrameSize)
+	}
+	if sib.Channels < StreaminfoChannelCountMinimum || sib.Channels > StreaminfoChannelCountMaximum {
+		return fmt.Errorf("FATAL: invalid Channels: %d. Must be between %d and %d.", sib.Channels, StreaminfoChannelCountMinimum, StreaminfoChannelCountMaximum)
+	}
+	if sib.BitsPerSample < StreaminfoBitsPerSampleMinimum || sib.BitsPerSample > StreaminfoBitsPerSampleMaximum {
+		return fmt.Errorf("FATAL: invalid BitsPerSample: %d. Must be between %d and %d.", sib.BitsPerSample, StreaminfoBitsPerSampleMinimum, StreaminfoBitsPerSampleMaximum)
+	}
+	if sib.TotalSamples >= StreaminfoTotalSamplesMaximum {
+		return fmt.Errorf("FATAL: invalid TotalSamples: %d. Must fit in %d bits.", sib.TotalSamples, StreaminfoTotalSamplesLen)
+	}
 	return nil
 }
 
@@ -762,143 +1359,827 @@ func (vcb *VorbisCommentBlock) Parse(block []byte) error {
 	//    }
 	// 7) done.
 
-	// TODO: Add error checking here
-	buf := bytes.NewBuffer(block)
+	// The block is converted to a string once; the vendor string and the
+	// comments are substrings of it, so they share a single allocation.
+	data := string(block)
+	pos := 0
+	// Lengths are compared as uint64, which holds any 32 bit length, so a
+	// length above the largest int cannot turn negative and pass the check.
+	next := func(n uint32, name string) (string, error) {
+		if uint64(n) > uint64(len(data)-pos) {
+			return "", fmt.Errorf("FATAL: error reading %s field. Expected %d byte(s), got %d.", name, n, len(data)-pos)
+		}
+		v := data[pos : pos+int(n)]
+		pos += int(n)
+		return v, nil
+	}
+	u32 := func(n uint32, name string) (uint32, error) {
+		v, err := next(n, name)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint32([]byte(v)), nil
+	}
 
-	len := binary.LittleEndian.Uint32(buf.Next(VorbisCommentVendorLen / 8))
-	vcb.Vendor = string(buf.Next(int(len)))
+	n, err := u32(VorbisCommentVendorLen/8, "VendorLength")
+	if err != nil {
+		return err
+	}
+	if vcb.Vendor, err = next(n, "Vendor"); err != nil {
+		return err
+	}
 
-	vcb.TotalComments = binary.LittleEndian.Uint32(buf.Next(VorbisCommentUserCommentLen / 8))
+	if n, err = u32(VorbisCommentUserCommentLen/8, "TotalComments"); err != nil {
+		return err
+	}
+	vcb.TotalComments = n
 
-	for tc := vcb.TotalComments; tc > 0; tc-- {
-		len := binary.LittleEndian.Uint32(buf.Next(VorbisCommentCommentLengthLen / 8))
-		comment := string(buf.Next(int(len)))
+	// Every comment takes at least its 4 byte length, so a corrupt count
+	// larger than the block can hold is an error rather than a huge
+	// allocation or a run of empty comments.
+	if room := (len(data) - pos) / (VorbisCommentCommentLengthLen / 8); uint64(vcb.TotalComments) > uint64(room) {
+		return fmt.Errorf("FATAL: %d comments declared but only room for %d.", vcb.TotalComments, room)
+	}
+	vcb.Comments = make([]string, 0, vcb.TotalComments)
+	for i := 0; i < int(vcb.TotalComments); i++ {
+		if n, err = u32(VorbisCommentCommentLengthLen/8, "CommentLength"); err != nil {
+			return err
+		}
+		if uint64(n) > uint64(len(data)-pos) {
+			return fmt.Errorf("FATAL: error reading comment %d of %d. Expected %d byte(s), got %d.", i+1, vcb.TotalComments, n, len(data)-pos)
+		}
+		comment, _ := next(n, "Comment")
 		vcb.Comments = append(vcb.Comments, comment)
 	}
 	return nil
 }
 
-// ReadFLACMetatada reads the metadata from a FLAC file and populates a Metadata struct.
-func (meta *Metadata) Read(f io.Reader) error {
+// Tags splits each comment into a field name and value at the first '=' and
+// groups the values by field name. Field names are case-insensitive, so they
+// are upper-cased; repeated fields such as ARTIST keep their values in
+// comment order. Comments without an '=' are kept whole under the "" key.
+func (vcb *VorbisCommentBlock) Tags() map[string][]string {
+	tags := make(map[string][]string)
+	for _, comment := range vcb.Comments {
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			key, value = "", comment
+		}
+		key = strings.ToUpper(key)
+		tags[key] = append(tags[key], value)
+	}
+	return tags
+}
+
+// Get returns the value of the first comment whose field name matches key,
+// ignoring case. ok is false if no comment has that field name.
+func (vcb *VorbisCommentBlock) Get(key string) (value string, ok bool) {
+	for _, comment := range vcb.Comments {
+		k, v, found := strings.Cut(comment, "=")
+		if found && strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Set replaces every comment whose field name matches key, ignoring case,
+// with the single comment key=value. The new comment takes the place of the
+// first match, or is appended if there was none; key is written as given.
+func (vcb *VorbisCommentBlock) Set(key, value string) {
+	comments := vcb.Comments[:0]
+	set := false
+	for _, comment := range vcb.Comments {
+		if k, _, found := strings.Cut(comment, "="); found && strings.EqualFold(k, key) {
+			if set {
+				continue
+			}
+			comment, set = key+"="+value, true
+		}
+		comments = append(comments, comment)
+	}
+	vcb.Comments = comments
+	if !set {
+		vcb.Comments = append(vcb.Comments, key+"="+value)
+	}
+	vcb.TotalComments = uint32(len(vcb.Comments))
+}
+
+// Add appends the comment key=value, keeping any existing values of key.
+func (vcb *VorbisCommentBlock) Add(key, value string) {
+	vcb.Comments = append(vcb.Comments, key+"="+value)
+	vcb.TotalComments = uint32(len(vcb.Comments))
+}
+
+// CountMatching returns the number of comments for which fn returns true.
+// fn is given each field name as written, so compare it with
+// strings.EqualFold, and its value; a comment without '=' is passed as an
+// empty key and the whole comment as the value, as Tags does. No memory is
+// allocated.
+func (vcb *VorbisCommentBlock) CountMatching(fn func(key, value string) bool) int {
+	n := 0
+	for _, comment := range vcb.Comments {
+		key, value, ok := strings.Cut(comment, "=")
+		if !ok {
+			key, value = "", comment
+		}
+		if fn(key, value) {
+			n++
+		}
+	}
+	return n
+}
+
+// Remove deletes every comment whose field name matches key, ignoring case.
+func (vcb *VorbisCommentBlock) Remove(key string) {
+	comments := vcb.Comments[:0]
+	for _, comment := range vcb.Comments {
+		if k, _, found := strings.Cut(comment, "="); found && strings.EqualFold(k, key) {
+			continue
+		}
+		comments = append(comments, comment)
+	}
+	vcb.Comments = comments
+	vcb.TotalComments = uint32(len(vcb.Comments))
+}
+
+// SuspiciousTags returns the comments that contain a control character
+// other than tab and newline, such as a NUL left by a buggy tagger, in file
+// order. Parse accepts such comments; this only finds them.
+func (vcb *VorbisCommentBlock) SuspiciousTags() []string {
+	var tags []string
+	for _, comment := range vcb.Comments {
+		for i := 0; i < len(comment); i++ {
+			if c := comment[i]; c < 0x20 && c != '\t' && c != '\n' {
+				tags = append(tags, comment)
+				break
+			}
+		}
+	}
+	return tags
+}
+
+// ValidateUTF8 checks that the vendor string and every comment are valid
+// UTF-8, as the Vorbis comment specification requires. The error lists each
+// invalid entry, numbering comments from 0; such data was most likely
+// written as Latin-1 by an old tagger.
+func (vcb *VorbisCommentBlock) ValidateUTF8() error {
+	var bad []string
+	if !utf8.ValidString(vcb.Vendor) {
+		bad = append(bad, "vendor string")
+	}
+	for i, comment := range vcb.Comments {
+		if !utf8.ValidString(comment) {
+			bad = append(bad, fmt.Sprintf("comment[%d]", i))
+		}
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("FATAL: invalid UTF-8 in %s.", strings.Join(bad, ", "))
+	}
+	return nil
+}
+
+// ReplayGain holds the ReplayGain values of a stream: gains in dB and peaks
+// as a fraction of full scale. Each Has field reports whether the value
+// beside it was present and could be parsed.
+type ReplayGain struct {
+	TrackGain    float64
+	HasTrackGain bool
+	TrackPeak    float64
+	HasTrackPeak bool
+	AlbumGain    float64
+	HasAlbumGain bool
+	AlbumPeak    float64
+	HasAlbumPeak bool
+}
+
+// ReplayGain parses the REPLAYGAIN_TRACK_GAIN, REPLAYGAIN_TRACK_PEAK,
+// REPLAYGAIN_ALBUM_GAIN and REPLAYGAIN_ALBUM_PEAK comments, such as
+// "-6.54 dB" and "0.988". A missing or malformed field is left unset; ok is
+// false if none of them could be parsed, so fields that are all malformed
+// look the same as no fields.
+func (vcb *VorbisCommentBlock) ReplayGain() (rg ReplayGain, ok bool) {
+	parse := func(key string, v *float64, has *bool) {
+		s, found := vcb.Get(key)
+		if !found {
+			return
+		}
+		s = strings.TrimSpace(s)
+		if len(s) > 2 && strings.EqualFold(s[len(s)-2:], "dB") {
+			s = strings.TrimSpace(s[:len(s)-2])
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return
+		}
+		*v, *has = f, true
+		ok = true
+	}
+	parse(CommentReplayGainTrackGain, &rg.TrackGain, &rg.HasTrackGain)
+	parse(CommentReplayGainTrackPeak, &rg.TrackPeak, &rg.HasTrackPeak)
+	parse(CommentReplayGainAlbumGain, &rg.AlbumGain, &rg.HasAlbumGain)
+	parse(CommentReplayGainAlbumPeak, &rg.AlbumPeak, &rg.HasAlbumPeak)
+	return rg, ok
+}
+
+// AddReplayGainPlaceholders adds each of the REPLAYGAIN_TRACK_GAIN,
+// REPLAYGAIN_TRACK_PEAK, REPLAYGAIN_ALBUM_GAIN and REPLAYGAIN_ALBUM_PEAK
+// comments that vcb lacks, with a gain of "+0.00 dB" and a peak of
+// "0.000000", for a ReplayGain analyzer to fill in later. Fields already
+// present are left alone, so calling it again changes nothing. It reports
+// whether any comment was added.
+func (vcb *VorbisCommentBlock) AddReplayGainPlaceholders() bool {
+	added := false
+	for _, f := range []struct{ key, value string }{
+		{CommentReplayGainTrackGain, "+0.00 dB"},
+		{CommentReplayGainTrackPeak, "0.000000"},
+		{CommentReplayGainAlbumGain, "+0.00 dB"},
+		{CommentReplayGainAlbumPeak, "0.000000"},
+	} {
+		if _, ok := vcb.Get(f.key); !ok {
+			vcb.Add(f.key, f.value)
+			added = true
+		}
+	}
+	return added
+}
+
+// WalkMetadata reads the metadata blocks of the FLAC stream in r and calls fn
+// with the header and data of each block, in file order, until the block
+// with the last-metadata-block flag set has been handled. Nothing after that
+// block is read, so a later block that also claims to be last is part of the
+// audio as far as WalkMetadata is concerned. If fn returns an error,
+// WalkMetadata stops reading and returns that error. The data slice is not
+// reused, so fn may retain it.
+func WalkMetadata(r io.Reader, fn func(*MetadataBlockHeader, []byte) error) error {
+	return walkMetadata(r, -1, fn)
+}
+
+// walkMetadata is WalkMetadata failing with ErrMetadataTooLarge, before the
+// data of the block that would go over it is read, once the blocks add up to
+// more than limit bytes, headers included. A negative limit means none.
+func walkMetadata(r io.Reader, limit int64, fn func(*MetadataBlockHeader, []byte) error) error {
 	// First 4 bytes of the file are the FLAC stream marker: 0x66, 0x4C, 0x61, 0x43
 	// It's also the length of all metadata block headers so we'll resue it below.
 	h := make([]byte, MetadataBlockHeaderLen/8)
 
-	n, err := io.ReadFull(f, h)
+	n, err := io.ReadFull(r, h)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("FATAL: error reading FLAC signature: %w: %w", ErrTruncatedFile, err)
+	}
 	if err != nil || n != int(MetadataBlockHeaderLen/8) {
-		return fmt.Errorf("FATAL: error reading FLAC signature: %s", err)
+		return fmt.Errorf("FATAL: error reading FLAC signature: %w", err)
+	}
+
+	// Skip an ID3v2 tag wrongly prepended to the file, and read the
+	// signature after it.
+	offset := int64(0)
+	if string(h[:3]) == ID3v2Signature {
+		if offset, err = skipID3v2(r, h); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(r, h); err != nil {
+			return fmt.Errorf("FATAL: error reading FLAC signature after ID3v2 tag: %w: %w", ErrTruncatedFile, err)
+		}
 	}
 
 	if string(h) != FlacSignature {
-		return fmt.Errorf("FATAL: '%s' is not a valid FLAC signature.", string(h))
+		if format := sniffFormat(h); format != "" {
+			return fmt.Errorf("FATAL: '%s' is not a valid FLAC signature; the file starts with %s: %w", string(h), format, ErrNotFLAC)
+		}
+		return fmt.Errorf("FATAL: '%s' is not a valid FLAC signature: %w", string(h), ErrNotFLAC)
 	}
 
-	for totalMBH := 0; ; totalMBH++ {
+	start := offset
+	offset += int64(len(FlacSignature))
+	for blocks := 0; ; blocks++ {
 		// Next 4 bytes after the stream marker is the first metadata block header.
-		n, err := io.ReadFull(f, h)
+		n, err := io.ReadFull(r, h)
+		if err == io.EOF && blocks > 0 {
+			return fmt.Errorf("FATAL: end of file after %d metadata block(s): %w: %w", blocks, ErrNoLastBlock, ErrTruncatedFile)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("FATAL: error reading metadata block header: %w: %w", ErrTruncatedFile, err)
+		}
 		if err != nil || n != int(MetadataBlockHeaderLen/8) {
-			return fmt.Errorf("FATAL: error reading metadata block header: %s", err)
+			return fmt.Errorf("FATAL: error reading metadata block header: %w", err)
+		}
+
+		// A header starting with the 14 bit frame sync code means the audio
+		// has begun without any block being flagged as the last.
+		if blocks > 0 && h[0] == 0xFF && h[1]&0xFE == 0xF8 {
+			return fmt.Errorf("FATAL: audio frame found after %d metadata block(s): %w", blocks, ErrNoLastBlock)
 		}
 
 		mbh := new(MetadataBlockHeader)
 		err = mbh.Parse(h)
 		if err != nil {
-			return err
+			return &ParseError{Index: blocks, Type: mbh.Type, Offset: offset, Err: err}
+		}
+
+		if size := offset - start + MetadataBlockHeaderLen/8 + int64(mbh.Length); limit >= 0 && size > limit {
+			err := fmt.Errorf("FATAL: metadata of at least %d bytes is over the %d byte limit: %w", size, limit, ErrMetadataTooLarge)
+			return &ParseError{Index: blocks, Type: mbh.Type, Offset: offset, Err: err}
 		}
 
-		block := make([]byte, mbh.Length)
-		n, err = io.ReadFull(f, block)
+		block, n, err := readBlock(r, mbh.Length)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("FATAL: %s metadata block is %d byte(s) short: %w", mbh.Type, int(mbh.Length)-n, ErrTruncatedBlock)
+			return &ParseError{Index: blocks, Type: mbh.Type, Offset: offset, Err: err}
+		}
 		if err != nil || n != int(len(block)) {
-			return fmt.Errorf("FATAL: read %d of %d bytes for %s metadata block: %s", n, mbh.Length, mbh.Type, err)
+			err = fmt.Errorf("FATAL: read %d of %d bytes for %s metadata block: %w", n, mbh.Length, mbh.Type, err)
+			return &ParseError{Index: blocks, Type: mbh.Type, Offset: offset, Err: err}
 		}
 
-		switch mbh.Type {
-		case MetadataStreaminfo:
-			if meta.Streaminfo.IsPopulated {
-				return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
-			}
+		if err := fn(mbh, block); err != nil {
+			return err
+		}
+		offset += MetadataBlockHeaderLen/8 + int64(mbh.Length)
 
-			sib := new(StreaminfoBlock)
-			err := sib.Parse(block)
-			if err != nil {
-				return err
-			}
+		if mbh.Last {
+			return nil
+		}
+	}
+}
 
-			meta.Streaminfo = Streaminfo{mbh, sib, true}
+// Read reads the metadata from a FLAC file and populates a Metadata struct.
+// Both native FLAC and Ogg FLAC files are read; for the latter, Ogg is set. An
+// ID3v2 tag before the "fLaC" signature is skipped, and its length recorded
+// in ID3v2Length.
+func (meta *Metadata) Read(f io.Reader) error {
+	return meta.walk(f, meta.parseBlock)
+}
 
-		case MetadataVorbisComment:
-			if meta.VorbisComment.IsPopulated {
-				return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
-			}
+// walk calls WalkOggMetadata or WalkMetadata, as suits the start of f, and
+// records the length of any ID3v2 tag in meta.
+func (meta *Metadata) walk(f io.Reader, fn func(*MetadataBlockHeader, []byte) error) error {
+	// A sliceReader can be looked at without consuming it; another reader
+	// is given back the bytes read.
+	var sig []byte
+	r := f
+	if sr, ok := f.(*sliceReader); ok {
+		sig = sr.data[sr.off:]
+	} else {
+		sig = make([]byte, id3v2HeaderLen)
+		n, _ := io.ReadFull(f, sig)
+		sig = sig[:n]
+		r = io.MultiReader(bytes.NewReader(sig), f)
+	}
+	meta.ID3v2Length, _ = id3v2Length(sig)
+	limit := meta.MaxMetadataBytes
+	if limit == 0 {
+		limit = DefaultMaxMetadataBytes
+	}
+	meta.Ogg = bytes.HasPrefix(sig, []byte(OggSignature))
+	if meta.Ogg {
+		return walkOggMetadata(r, limit, fn)
+	}
+	return walkMetadata(r, limit, fn)
+}
 
-			vcb := new(VorbisCommentBlock)
-			err := vcb.Parse(block)
-			if err != nil {
-				return err
-			}
+// errStopWalk is returned by a WalkMetadata callback to stop reading once
+// the blocks it needs have been read.
+var errStopWalk = errors.New("stop walking metadata")
+
+// ParseStreamInfo reads only the STREAMINFO block of the FLAC stream in r,
+// which the format requires to be the first block, and stops there: r is
+// left at the block after it. It is much faster than ParseMetadata when the
+// comments and pictures are not needed. It is an error for the first block
+// not to be STREAMINFO.
+func ParseStreamInfo(r io.Reader) (*StreaminfoBlock, error) {
+	meta := new(Metadata)
+	err := meta.walk(r, func(mbh *MetadataBlockHeader, block []byte) error {
+		if err := meta.parseBlock(mbh, block); err != nil {
+			return err
+		}
+		return errStopWalk
+	})
+	if err != errStopWalk {
+		return nil, err
+	}
+	return meta.Streaminfo.Data, nil
+}
 
-			meta.VorbisComment = VorbisComment{mbh, vcb, true}
+// parseBlock decodes a metadata block read by WalkMetadata into meta.
+func (meta *Metadata) parseBlock(mbh *MetadataBlockHeader, block []byte) error {
+	b := &Block{Header: mbh, Offset: meta.ID3v2Length + int64(len(FlacSignature))}
+	if n := len(meta.Blocks); n > 0 {
+		b.Offset = meta.Blocks[n-1].Offset + meta.Blocks[n-1].Len()
+	}
+	meta.Blocks = append(meta.Blocks, b)
 
-		case MetadataPicture:
-			fpb := new(PictureBlock)
-			err := fpb.Parse(block)
-			if err != nil {
-				return err
-			}
-			meta.Pictures = append(meta.Pictures, &Picture{mbh, fpb, true})
+	if err := meta.decodeBlock(b, block); err != nil {
+		return &ParseError{Index: len(meta.Blocks) - 1, Type: mbh.Type, Offset: b.Offset, Err: err}
+	}
+	return nil
+}
 
-		case MetadataPadding:
-			if meta.Padding.IsPopulated {
-				return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
-			}
-			meta.Padding = Padding{mbh, nil, true}
+// decodeBlock decodes the data of b, the latest block in meta.Blocks, into
+// the typed fields of meta.
+func (meta *Metadata) decodeBlock(b *Block, block []byte) error {
+	mbh := b.Header
 
-		case MetadataApplication:
-			if meta.Application.IsPopulated {
-				return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
-			}
+	// STREAMINFO must be the first block, and the check for duplicate
+	// blocks below keeps it the only one.
+	if len(meta.Blocks) == 1 && mbh.Type != MetadataStreaminfo {
+		return fmt.Errorf("FATAL: first metadata block is %s, expected %s: %w", mbh.Type, MetadataStreaminfo, ErrMissingStreamInfo)
+	}
+
+	switch mbh.Type {
+	case MetadataStreaminfo:
+		if meta.Streaminfo.IsPopulated {
+			return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
+		}
 
-			fab := new(ApplicationBlock)
-			err := fab.Parse(block)
-			if err != nil {
+		sib := new(StreaminfoBlock)
+		err := sib.Parse(block)
+		if err != nil {
+			return err
+		}
+		if meta.Strict {
+			if err := sib.Validate(); err != nil {
 				return err
 			}
-			meta.Application = Application{mbh, fab, true}
+		}
 
-		case MetadataSeektable:
-			if meta.Seektable.IsPopulated {
-				return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
-			}
-			if len(block)%(SeekpointBlockLen/8) != 0 {
-				return fmt.Errorf("FATAL: %s block length is not a multiple of %d.", mbh.Type, (SeekpointBlockLen / 8))
-			}
+		meta.Streaminfo = Streaminfo{mbh, sib, true}
 
-			err := meta.Seektable.Parse(block)
-			if err != nil {
-				return err
-			}
-			meta.Seektable.Header = mbh
-			meta.Seektable.IsPopulated = true
+	case MetadataVorbisComment:
+		// Extra VORBIS_COMMENT blocks are kept in VorbisComments;
+		// VorbisComment holds the first.
+		vcb := new(VorbisCommentBlock)
+		err := vcb.Parse(block)
+		if err != nil {
+			return err
+		}
 
-		case MetadataCuesheet:
-			if meta.Cuesheet.IsPopulated {
-				return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
-			}
+		vc := &VorbisComment{mbh, vcb, true}
+		meta.VorbisComments = append(meta.VorbisComments, vc)
+		if !meta.VorbisComment.IsPopulated {
+			meta.VorbisComment = *vc
+		}
 
-			csb := new(CuesheetBlock)
-			err := csb.Parse(block)
-			if err != nil {
-				return err
-			}
-			meta.Cuesheet = Cuesheet{mbh, csb, true}
+	case MetadataPicture:
+		fpb := new(PictureBlock)
+		err := fpb.Parse(block)
+		if err != nil {
+			return err
+		}
+		meta.Pictures = append(meta.Pictures, &Picture{mbh, fpb, true})
 
-		default:
-			continue
+	case MetadataPadding:
+		// Any number of PADDING blocks is allowed; Padding holds the first.
+		fpb := new(PaddingBlock)
+		err := fpb.Parse(block)
+		if err != nil {
+			return err
+		}
+		if !meta.Padding.IsPopulated {
+			meta.Padding = Padding{mbh, fpb, true}
 		}
 
-		if mbh.Last {
-			break
+	case MetadataApplication:
+		if meta.Application.IsPopulated {
+			return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
+		}
+
+		fab := new(ApplicationBlock)
+		err := fab.Parse(block)
+		if err != nil {
+			return err
+		}
+		meta.Application = Application{mbh, fab, true}
+
+	case MetadataSeektable:
+		if meta.Seektable.IsPopulated {
+			return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
+		}
+		if len(block)%(SeekpointBlockLen/8) != 0 {
+			return fmt.Errorf("FATAL: %s block length is not a multiple of %d.", mbh.Type, (SeekpointBlockLen / 8))
+		}
+
+		err := meta.Seektable.Parse(block)
+		if err != nil {
+			return err
+		}
+		meta.Seektable.Header = mbh
+		meta.Seektable.IsPopulated = true
+
+	case MetadataCuesheet:
+		if meta.Cuesheet.IsPopulated {
+			return fmt.Errorf("FATAL: Two %s blocks encountered.", mbh.Type)
+		}
+
+		csb := new(CuesheetBlock)
+		err := csb.Parse(block)
+		if err != nil {
+			return err
+		}
+		meta.Cuesheet = Cuesheet{mbh, csb, true}
+
+	default:
+		if meta.Strict {
+			return fmt.Errorf("FATAL: undefined block type %d.", uint8(mbh.Type))
 		}
 	}
+	b.Raw = block
 	return nil
 }
+
+// ParseMetadata reads every metadata block from r, stopping after the block
+// with the last-metadata-block flag set, and returns the populated Metadata.
+// r need not be seekable: exactly the bytes of the metadata are consumed, so
+// on success r is left positioned at the first audio frame. The package
+// keeps no mutable state, so ParseMetadata may be called from many
+// goroutines at once, each with its own reader.
+func ParseMetadata(r io.Reader) (*Metadata, error) {
+	return ParseMetadataContext(context.Background(), r)
+}
+
+// ParseMetadataContext is ParseMetadata, returning ctx.Err() if ctx is done
+// before reading starts or between two blocks. A read that is already
+// blocked is not interrupted; close r, or give it a deadline, for that.
+func ParseMetadataContext(ctx context.Context, r io.Reader) (*Metadata, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	meta := new(Metadata)
+	err := meta.walk(r, func(mbh *MetadataBlockHeader, block []byte) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return meta.parseBlock(mbh, block)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// ParseMetadataBytes is ParseMetadata for a file already held in memory.
+// It reads data through the same code as ParseMetadata, but the blocks of a
+// native FLAC file are sliced from data rather than copied, so byte slices
+// of the result, such as Block.Raw and PictureBlob, may share data's memory.
+// data may hold the audio frames too, or end with the metadata.
+func ParseMetadataBytes(data []byte) (*Metadata, error) {
+	meta := new(Metadata)
+	if err := meta.walk(&sliceReader{data: data}, meta.parseBlock); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// sliceReader is an io.Reader of data from which WalkMetadata takes block
+// data by slicing instead of copying; see readBlock.
+type sliceReader struct {
+	data []byte
+	off  int
+}
+
+func (sr *sliceReader) Read(p []byte) (int, error) {
+	if sr.off >= len(sr.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, sr.data[sr.off:])
+	sr.off += n
+	return n, nil
+}
+
+// readBlock reads the n bytes of a block's data from r, returning how many
+// were read and an error as io.ReadFull does. Data read from a sliceReader
+// is not copied.
+func readBlock(r io.Reader, n uint32) ([]byte, int, error) {
+	if sr, ok := r.(*sliceReader); ok {
+		if left := len(sr.data) - sr.off; int64(n) > int64(left) {
+			sr.off = len(sr.data)
+			if left == 0 {
+				return nil, 0, io.EOF
+			}
+			return nil, left, io.ErrUnexpectedEOF
+		}
+		start, end := sr.off, sr.off+int(n)
+		sr.off = end
+		return sr.data[start:end:end], int(n), nil
+	}
+	block := make([]byte, n)
+	m, err := io.ReadFull(r, block)
+	return block, m, err
+}
+
+// PrimaryComments returns the first VORBIS_COMMENT block, the one a
+// conforming file has, as WriteTo would write it, or nil if there is none.
+func (meta *Metadata) PrimaryComments() *VorbisCommentBlock {
+	for _, b := range meta.Blocks {
+		if b.Header.Type == MetadataVorbisComment {
+			return meta.VorbisCommentOf(b.Header)
+		}
+	}
+	return nil
+}
+
+// VorbisCommentOf returns the data of the VORBIS_COMMENT block with header
+// mbh, which WriteTo writes for it; non-conforming files may have several.
+// The primary block is taken from VorbisComment, in case its Data was
+// replaced, and the others from VorbisComments.
+func (meta *Metadata) VorbisCommentOf(mbh *MetadataBlockHeader) *VorbisCommentBlock {
+	if meta.VorbisComment.Header == mbh {
+		return meta.VorbisComment.Data
+	}
+	for _, vc := range meta.VorbisComments {
+		if vc.Header == mbh {
+			return vc.Data
+		}
+	}
+	return meta.VorbisComment.Data
+}
+
+// Picture returns the first PICTURE block of the given APIC picture type,
+// such as PictureCoverFront, and reports whether one was found.
+func (meta *Metadata) Picture(pictureType uint32) (*PictureBlock, bool) {
+	for _, pic := range meta.Pictures {
+		if pic.Data.PictureTypeId == pictureType {
+			return pic.Data, true
+		}
+	}
+	return nil, false
+}
+
+// BlockCount returns the number of metadata blocks read, len(meta.Blocks).
+func (meta *Metadata) BlockCount() int {
+	return len(meta.Blocks)
+}
+
+// BlockTypes returns the names of the types of the blocks read, in file
+// order, as given by MetadataBlockType.String.
+func (meta *Metadata) BlockTypes() []string {
+	types := make([]string, len(meta.Blocks))
+	for i, b := range meta.Blocks {
+		types[i] = b.Header.Type.String()
+	}
+	return types
+}
+
+// AddPadding appends a PADDING block of n zero bytes as the last metadata
+// block, as metaflac --add-padding does, so that later edits can be made in
+// place. The block before it is no longer flagged as the last.
+func (meta *Metadata) AddPadding(n uint32) {
+	mbh := &MetadataBlockHeader{Type: MetadataPadding, Length: n, Last: true}
+	b := &Block{Header: mbh, Offset: meta.ID3v2Length + int64(len(FlacSignature))}
+	if len(meta.Blocks) > 0 {
+		b.Offset = meta.MetadataLength()
+		meta.Blocks[len(meta.Blocks)-1].Header.Last = false
+	}
+	meta.Blocks = append(meta.Blocks, b)
+	if !meta.Padding.IsPopulated {
+		meta.Padding = Padding{mbh, &PaddingBlock{Length: n, IsZero: true}, true}
+	}
+}
+
+// RemovePadding removes every PADDING block from meta.Blocks, as metaflac
+// --remove --block-type=PADDING does, and flags the new final block as the
+// last. Block offsets are recomputed.
+func (meta *Metadata) RemovePadding() {
+	blocks := meta.Blocks[:0]
+	for _, b := range meta.Blocks {
+		if b.Header.Type != MetadataPadding {
+			blocks = append(blocks, b)
+		}
+	}
+	meta.Blocks = blocks
+	meta.Padding = Padding{}
+	meta.relink()
+}
+
+// relink recomputes the offset of each block in meta.Blocks after blocks
+// are removed or inserted, and flags only the final block as the last.
+func (meta *Metadata) relink() {
+	offset := meta.ID3v2Length + int64(len(FlacSignature))
+	for i, b := range meta.Blocks {
+		b.Offset = offset
+		offset += b.Len()
+		b.Header.Last = i == len(meta.Blocks)-1
+	}
+}
+
+// StripToStreamInfo removes every block but STREAMINFO, which is flagged as
+// the last: the tags, pictures, cuesheet, application data, padding and the
+// seektable, and blocks of unknown type. WriteTo then writes a file with no
+// optional metadata, as before publishing a sample. meta must have been
+// read, so that it has a STREAMINFO block.
+func (meta *Metadata) StripToStreamInfo() {
+	var blocks []*Block
+	for _, b := range meta.Blocks {
+		if b.Header == meta.Streaminfo.Header {
+			blocks = append(blocks, b)
+		}
+	}
+	meta.Blocks = blocks
+	meta.Application = Application{}
+	meta.VorbisComment = VorbisComment{}
+	meta.VorbisComments = nil
+	meta.Pictures = nil
+	meta.Padding = Padding{}
+	meta.Seektable = Seektable{}
+	meta.Cuesheet = Cuesheet{}
+	if meta.Streaminfo.Header != nil {
+		meta.Streaminfo.Header.Last = true
+	}
+}
+
+// AvailablePadding returns the bytes an in-place edit could reclaim: the
+// length of every PADDING block plus its 4 byte header. A block that grows
+// by no more than this can be written without moving the audio, as metaflac
+// does, though WriteVorbisCommentInPlace only uses the padding directly
+// after the VORBIS_COMMENT block.
+func (meta *Metadata) AvailablePadding() int {
+	n := 0
+	for _, b := range meta.Blocks {
+		if b.Header.Type == MetadataPadding {
+			n += int(b.Len())
+		}
+	}
+	return n
+}
+
+// MetadataLength returns the number of bytes the metadata occupies at the
+// start of the file, counting any ID3v2 tag before it, the "fLaC" signature
+// and every block header. It is 0 if no block has been read.
+func (meta *Metadata) MetadataLength() int64 {
+	n := len(meta.Blocks)
+	if n == 0 {
+		return 0
+	}
+	return meta.Blocks[n-1].Offset + meta.Blocks[n-1].Len()
+}
+
+// AudioOffset returns the byte offset, from the start of the file, of the
+// first audio frame. It is the same as MetadataLength. ok is false if the
+// metadata was read from Ogg FLAC, whose audio is in Ogg pages at no offset
+// the blocks give.
+func (meta *Metadata) AudioOffset() (offset int64, ok bool) {
+	if meta.Ogg {
+		return 0, false
+	}
+	return meta.MetadataLength(), true
+}
+
+// AverageBitrate returns the average bitrate of the audio, in kbit/s, given
+// the size of the whole file: the bytes after AudioOffset divided by the
+// duration from STREAMINFO. ok is false if TotalSamples or SampleRate is 0,
+// fileSize does not reach past the metadata, or AudioOffset is not known.
+func (meta *Metadata) AverageBitrate(fileSize int64) (kbps int, ok bool) {
+	sib := meta.Streaminfo.Data
+	off, ok := meta.AudioOffset()
+	audio := fileSize - off
+	if !ok || sib == nil || sib.TotalSamples == 0 || sib.SampleRate == 0 || audio <= 0 {
+		return 0, false
+	}
+	bits := float64(audio) * 8
+	seconds := float64(sib.TotalSamples) / float64(sib.SampleRate)
+	return int(math.Round(bits / seconds / 1000)), true
+}
+
+// AudioReader returns a Reader over the audio frames of the FLAC file r,
+// from which meta was read, starting at AudioOffset. When the file is only
+// available as a stream, the reader passed to ParseMetadata is itself left
+// at the first audio frame and can be used instead. It is an error if meta
+// was read from Ogg FLAC.
+func (meta *Metadata) AudioReader(r io.ReaderAt) (io.Reader, error) {
+	off, ok := meta.AudioOffset()
+	if !ok {
+		return nil, fmt.Errorf("FATAL: the audio of an Ogg FLAC file is not at a single offset; only native FLAC is supported.")
+	}
+	return io.NewSectionReader(r, off, math.MaxInt64-off), nil
+}
+
+// Equal reports whether meta and other hold the same STREAMINFO, seek points,
+// Vorbis comments and pictures. Comments are compared as Tags groups them:
+// field names ignore case and the order of different fields does not
+// matter, but repeated values of one field, such as two ARTISTs, must be in
+// the same order. Pictures are compared in file order. Padding, block order
+// and other blocks are ignored.
+func (meta *Metadata) Equal(other *Metadata) bool {
+	if !reflect.DeepEqual(meta.Streaminfo.Data, other.Streaminfo.Data) ||
+		!reflect.DeepEqual(meta.Seektable.Data, other.Seektable.Data) {
+		return false
+	}
+
+	vc, ovc := meta.VorbisComment.Data, other.VorbisComment.Data
+	if (vc == nil) != (ovc == nil) {
+		return false
+	}
+	if vc != nil && (vc.Vendor != ovc.Vendor || !reflect.DeepEqual(vc.Tags(), ovc.Tags())) {
+		return false
+	}
+
+	if len(meta.Pictures) != len(other.Pictures) {
+		return false
+	}
+	for i, pic := range meta.Pictures {
+		if !reflect.DeepEqual(pic.Data, other.Pictures[i].Data) {
+			return false
+		}
+	}
+	return true
+}
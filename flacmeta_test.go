@@ -1,10 +1,21 @@
 package flac
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	. "launchpad.net/gocheck"
 	"os"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func Test(t *testing.T) { TestingT(t) }
@@ -15,6 +26,9 @@ var _ = Suite(&S{})
 
 func (s *S) TestParseMetadataBlockHeader1(c *C) {
 	f, err := os.Open("testdata/44100-16-mono.flac")
+	if os.IsNotExist(err) {
+		c.Skip("testdata/44100-16-mono.flac is not in the tree")
+	}
 	if err != nil {
 		fmt.Println("FATAL:", err)
 		os.Exit(-1)
@@ -43,7 +57,8 @@ func (s *S) TestParseMetadataBlockHeader1(c *C) {
 			Channels:      1,
 			BitsPerSample: 16,
 			TotalSamples:  1014300,
-			MD5Signature:  "e5ccc967ced6c111530e5c79e33c969e"},
+			MD5Signature:  "e5ccc967ced6c111530e5c79e33c969e",
+			MD5:           MD5Sum{0xe5, 0xcc, 0xc9, 0x67, 0xce, 0xd6, 0xc1, 0x11, 0x53, 0x0e, 0x5c, 0x79, 0xe3, 0x3c, 0x96, 0x9e}},
 		IsPopulated: true}
 	c.Check(metadata.Streaminfo.Header, DeepEquals, streaminfo.Header)
 	c.Check(metadata.Streaminfo.Data, DeepEquals, streaminfo.Data)
@@ -71,7 +86,7 @@ func (s *S) TestParseMetadataBlockHeader1(c *C) {
 			Length:     8175,
 			Last:       true,
 			SeekPoints: 0},
-		Data:        nil,
+		Data:        &PaddingBlock{Length: 8175, IsZero: true},
 		IsPopulated: true}
 	c.Check(pad, DeepEquals, metadata.Padding)
 	c.Check(metadata.Padding, DeepEquals, pad)
@@ -103,6 +118,9 @@ func (s *S) TestParseMetadataBlockHeader1(c *C) {
 
 func (s *S) TestParseMetadataBlockHeader2(c *C) {
 	f, err := os.Open("testdata/mutagen/silence-44-s.flac")
+	if os.IsNotExist(err) {
+		c.Skip("testdata/mutagen/silence-44-s.flac is not in the tree")
+	}
 	if err != nil {
 		fmt.Println("FATAL:", err)
 		os.Exit(-1)
@@ -128,7 +146,8 @@ func (s *S) TestParseMetadataBlockHeader2(c *C) {
 			Channels:      2,
 			BitsPerSample: 16,
 			TotalSamples:  162496,
-			MD5Signature:  "6291dbd8dcb7dc480132e4c4ba154a17"},
+			MD5Signature:  "6291dbd8dcb7dc480132e4c4ba154a17",
+			MD5:           MD5Sum{0x62, 0x91, 0xdb, 0xd8, 0xdc, 0xb7, 0xdc, 0x48, 0x01, 0x32, 0xe4, 0xc4, 0xba, 0x15, 0x4a, 0x17}},
 		IsPopulated: true}
 	c.Check(metadata.Streaminfo.Header, DeepEquals, streaminfo.Header)
 	c.Check(metadata.Streaminfo.Data, DeepEquals, streaminfo.Data)
@@ -316,9 +335,1277 @@ func (s *S) TestParseMetadataBlockHeader2(c *C) {
 			Length:     3060,
 			Last:       true,
 			SeekPoints: 0},
-		Data:        nil,
+		Data:        &PaddingBlock{Length: 3060, IsZero: true},
 		IsPopulated: true}
 	c.Check(metadata.Padding.Header, DeepEquals, pad.Header)
 	c.Check(metadata.Padding.Data, DeepEquals, pad.Data)
 	c.Check(metadata.Padding.IsPopulated, DeepEquals, pad.IsPopulated)
 }
+
+// mkBlock returns a metadata block header of type t followed by data.
+func mkBlock(t MetadataBlockType, last bool, data []byte) []byte {
+	h := uint32(t)<<24 | uint32(len(data))
+	if last {
+		h |= 1 << 31
+	}
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint32(b, h)
+	return append(b, data...)
+}
+
+// mkStreaminfo returns the data of a STREAMINFO block matching the one in
+// testdata/44100-16-mono.flac.
+func mkStreaminfo() []byte {
+	b := []byte{0x10, 0x00, 0x10, 0x00, 0x00, 0x00, 0x0b, 0x00, 0x00, 0x0e}
+	bits := make([]byte, 8)
+	binary.BigEndian.PutUint64(bits, 44100<<44|0<<41|15<<36|1014300)
+	b = append(b, bits...)
+	return append(b, 0xe5, 0xcc, 0xc9, 0x67, 0xce, 0xd6, 0xc1, 0x11,
+		0x53, 0x0e, 0x5c, 0x79, 0xe3, 0x3c, 0x96, 0x9e)
+}
+
+// mkStream returns a FLAC stream made of the signature and blocks.
+func mkStream(blocks ...[]byte) []byte {
+	return append([]byte(FlacSignature), bytes.Join(blocks, nil)...)
+}
+
+func (s *S) TestParseMetadataReservedBlock(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataBlockType(100), false, []byte("abc")),
+		mkBlock(MetadataPadding, true, make([]byte, 8)))
+
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Check(meta.Streaminfo.IsPopulated, Equals, true)
+	c.Check(meta.Padding.IsPopulated, Equals, true)
+	c.Assert(meta.Blocks, HasLen, 3)
+	c.Check(meta.Blocks[0].Header, Equals, meta.Streaminfo.Header)
+	c.Check(meta.Blocks[0].Raw, DeepEquals, mkStreaminfo())
+	c.Check(meta.Blocks[1].Header.Type, Equals, MetadataBlockType(100))
+	c.Check(meta.Blocks[1].Header.Type.String(), Equals, "UNKNOWN")
+	c.Check(meta.Blocks[1].Raw, DeepEquals, []byte("abc"))
+	c.Check(meta.Blocks[2].Header.Last, Equals, true)
+}
+
+func (s *S) TestParseMetadataStreaminfoOnly(c *C) {
+	// Some encoders write a minimal stream: STREAMINFO flagged as the last
+	// block, followed directly by the audio frames.
+	stream := mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	audio := []byte{0xff, 0xf8, 0x69, 0x08}
+	r := bytes.NewReader(append(append([]byte(nil), stream...), audio...))
+
+	meta, err := ParseMetadata(r)
+	c.Assert(err, IsNil)
+	c.Check(meta.BlockTypes(), DeepEquals, []string{"STREAMINFO"})
+	c.Check(meta.Streaminfo.Header.Last, Equals, true)
+	c.Check(meta.Streaminfo.Data.SampleRate, Equals, uint32(44100))
+	c.Check(meta.VorbisComment.IsPopulated, Equals, false)
+	c.Check(meta.VorbisComments, IsNil)
+	c.Check(meta.PrimaryComments(), IsNil)
+	c.Check(meta.Pictures, IsNil)
+	c.Check(meta.Seektable.Data, IsNil)
+	c.Check(meta.Padding.IsPopulated, Equals, false)
+	c.Check(audioOffset(c, meta), Equals, int64(len(stream)))
+	rest, _ := io.ReadAll(r)
+	c.Check(rest, DeepEquals, audio)
+
+	fromBytes, err := ParseMetadataBytes(stream)
+	c.Assert(err, IsNil)
+	c.Check(fromBytes.Equal(meta), Equals, true)
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	c.Check(out.Bytes(), DeepEquals, stream)
+}
+
+func (s *S) TestParseMetadataStreaminfoPlacement(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	_, err := ParseMetadata(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, "block #1 \\(STREAMINFO\\) at offset 42: FATAL: Two STREAMINFO blocks encountered.")
+
+	stream = mkStream(
+		mkBlock(MetadataPadding, false, make([]byte, 4)),
+		mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	_, err = ParseMetadata(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, ".*: FATAL: first metadata block is PADDING, expected STREAMINFO: STREAMINFO is not the first block")
+	c.Check(errors.Is(err, ErrMissingStreamInfo), Equals, true)
+
+	// The stream ends after a "last" block that is not STREAMINFO.
+	_, err = ParseMetadata(bytes.NewReader(mkStream(mkBlock(MetadataVorbisComment, true, mkVorbisComment(1)))))
+	c.Check(errors.Is(err, ErrMissingStreamInfo), Equals, true)
+}
+
+func (s *S) TestParseError(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, false, make([]byte, 4)),
+		mkBlock(MetadataApplication, true, []byte("ab")))
+
+	_, err := ParseMetadata(bytes.NewReader(stream))
+	var pe *ParseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Check(pe.Index, Equals, 2)
+	c.Check(pe.Type, Equals, MetadataApplication)
+	c.Check(pe.Offset, Equals, int64(50))
+	c.Check(pe.Err, ErrorMatches, ".*error reading Id field.*")
+
+	_, err = ParseMetadata(bytes.NewReader(stream[:len(stream)-1]))
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Check(pe.Index, Equals, 2)
+	c.Check(errors.Is(err, ErrTruncatedBlock), Equals, true)
+}
+
+func (s *S) TestParseMetadataStrict(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, false, make([]byte, 4)),
+		mkBlock(MetadataBlockType(100), true, []byte("abc")))
+
+	meta := &Metadata{Strict: true}
+	err := meta.Read(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, "block #2 \\(UNKNOWN\\) at offset 50: FATAL: undefined block type 100.")
+
+	// A MinFrameSize above MaxFrameSize is read, except in strict mode.
+	block := mkStreaminfo()
+	copy(block[4:10], []byte{0, 0x10, 0, 0, 0, 0x20})
+	stream = mkStream(mkBlock(MetadataStreaminfo, true, block))
+	_, err = ParseMetadata(bytes.NewReader(stream))
+	c.Check(err, IsNil)
+	meta = &Metadata{Strict: true}
+	err = meta.Read(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, "block #0 \\(STREAMINFO\\) at offset 4: FATAL: MinFrameSize '4096' is larger than MaxFrameSize '32'.")
+}
+
+func (s *S) TestParseMetadataInvalidBlock(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataInvalid, true, nil))
+
+	_, err := ParseMetadata(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, ".*invalid block type: 127.*")
+}
+
+func (s *S) TestParseSeektablePlaceholder(c *C) {
+	block := []byte{
+		0, 0, 0, 0, 0, 0, 0x10, 0, 0, 0, 0, 0, 0, 0, 0x04, 0xd2, 0x10, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+	stb := new(Seektable)
+	c.Assert(stb.Parse(block), IsNil)
+	c.Assert(stb.Data, HasLen, 2)
+	c.Check(stb.Data[0], DeepEquals, &SeekpointBlock{SampleNumber: 4096, Offset: 1234, FrameSamples: 4096})
+	c.Check(stb.Data[0].IsPlaceholder(), Equals, false)
+	c.Check(stb.Data[1].IsPlaceholder(), Equals, true)
+}
+
+func (s *S) TestSeektableWithTimes(c *C) {
+	stb := &Seektable{Data: []*SeekpointBlock{
+		{SampleNumber: 0, FrameSamples: 4096},
+		{SampleNumber: 44100*3661 + 22050, Offset: 12000, FrameSamples: 4096},
+		{SampleNumber: 44099},
+		{SampleNumber: SeekpointPlaceholder}}}
+
+	points := stb.WithTimes(44100)
+	c.Assert(points, HasLen, 4)
+	c.Check(points[0].Time, Equals, "00:00:00.000")
+	c.Check(points[1].Time, Equals, "01:01:01.500")
+	c.Check(points[1].Offset, Equals, uint64(12000))
+	c.Check(points[2].Time, Equals, "00:00:01.000")
+	c.Check(points[3].Time, Equals, "placeholder")
+	c.Check(points[3].IsPlaceholder(), Equals, true)
+
+	c.Check(stb.WithTimes(0)[1].Time, Equals, "unknown")
+	c.Check(new(Seektable).WithTimes(44100), HasLen, 0)
+}
+
+func (s *S) TestFormatTimestamp(c *C) {
+	c.Check(FormatTimestamp(0), Equals, "00:00:00.000")
+	c.Check(FormatTimestamp(1499999*time.Microsecond), Equals, "00:00:01.500")
+	c.Check(FormatTimestamp(100*time.Hour+59*time.Second), Equals, "100:00:59.000")
+}
+
+func (s *S) TestSeekPointForSample(c *C) {
+	stb := &Seektable{Data: []*SeekpointBlock{
+		{SampleNumber: 0, Offset: 0, FrameSamples: 4096},
+		{SampleNumber: 40960, Offset: 12000, FrameSamples: 4096},
+		{SampleNumber: 81920, Offset: 25000, FrameSamples: 4096},
+		{SampleNumber: SeekpointPlaceholder}}}
+
+	spb, ok := stb.SeekPointForSample(50000)
+	c.Check(ok, Equals, true)
+	c.Check(spb.Offset, Equals, uint64(12000))
+
+	spb, _ = stb.SeekPointForSample(1 << 40)
+	c.Check(spb.Offset, Equals, uint64(25000))
+
+	stb.Data = stb.Data[1:]
+	_, ok = stb.SeekPointForSample(100)
+	c.Check(ok, Equals, false)
+}
+
+// mkPicture returns the data of a PICTURE block holding img.
+func mkPicture(typ uint32, mime, desc string, img []byte) []byte {
+	u32 := func(v uint32) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, v)
+		return b
+	}
+	b := u32(typ)
+	b = append(b, u32(uint32(len(mime)))...)
+	b = append(b, mime...)
+	b = append(b, u32(uint32(len(desc)))...)
+	b = append(b, desc...)
+	for _, v := range []uint32{1, 1, 24, 0, uint32(len(img))} {
+		b = append(b, u32(v)...)
+	}
+	return append(b, img...)
+}
+
+func (s *S) TestParsePicture(c *C) {
+	img := []byte("\x89PNG not really")
+	pb := new(PictureBlock)
+	c.Assert(pb.Parse(mkPicture(4, "image/png", "back", img)), IsNil)
+	c.Check(pb, DeepEquals, &PictureBlock{
+		PictureTypeId:      4,
+		PictureType:        "Cover (back)",
+		MimeType:           "image/png",
+		PictureDescription: "back",
+		Width:              1,
+		Height:             1,
+		ColorDepth:         24,
+		NumColors:          0,
+		Length:             uint32(len(img)),
+		PictureBlob:        img})
+}
+
+func (s *S) TestParsePictureTruncated(c *C) {
+	block := mkPicture(3, "image/png", "", []byte("data"))
+	pb := new(PictureBlock)
+	err := pb.Parse(block[:len(block)-1])
+	c.Check(err, ErrorMatches, "FATAL: error reading PictureBlob field. Expected 4 byte.*, got 3.")
+}
+
+func (s *S) TestMetadataPicture(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverBack, "image/png", "back", []byte("b"))),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverFront, "image/png", "front", []byte("f1"))),
+		mkBlock(MetadataPicture, true, mkPicture(PictureCoverFront, "image/png", "front2", []byte("f2"))))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	pb, ok := meta.Picture(PictureCoverFront)
+	c.Assert(ok, Equals, true)
+	c.Check(pb.PictureDescription, Equals, "front")
+
+	pb, ok = meta.Picture(PictureArtist)
+	c.Check(ok, Equals, false)
+	c.Check(pb, IsNil)
+}
+
+func (s *S) TestParseApplication(c *C) {
+	ab := new(ApplicationBlock)
+	c.Assert(ab.Parse([]byte("riffWAVE data")), IsNil)
+	c.Check(ab.Id, Equals, uint32(0x72696666))
+	c.Check(ab.Data, DeepEquals, []byte("WAVE data"))
+	id, ok := ab.IdString()
+	c.Check(id, Equals, "riff")
+	c.Check(ok, Equals, true)
+
+	ab = &ApplicationBlock{Id: 0x00010203}
+	_, ok = ab.IdString()
+	c.Check(ok, Equals, false)
+
+	c.Check(new(ApplicationBlock).Parse([]byte("ri")), ErrorMatches, ".*error reading Id field.*")
+}
+
+// mkCuesheetTrack returns a CUESHEET track with the given index offsets,
+// numbered from 1.
+func mkCuesheetTrack(offset uint64, number uint8, indexes ...uint64) []byte {
+	b := make([]byte, 8, 36+12*len(indexes))
+	binary.BigEndian.PutUint64(b, offset)
+	b = append(b, number)
+	b = append(b, make([]byte, 12+14)...)
+	b = append(b, uint8(len(indexes)))
+	for i, off := range indexes {
+		idx := make([]byte, 12)
+		binary.BigEndian.PutUint64(idx, off)
+		idx[8] = uint8(i + 1)
+		b = append(b, idx...)
+	}
+	return b
+}
+
+// mkCuesheet returns the data of a CUESHEET block holding tracks.
+func mkCuesheet(cd bool, tracks ...[]byte) []byte {
+	b := make([]byte, 128+8+259)
+	if cd {
+		b[128+8] = 0x80
+	}
+	b = append(b, uint8(len(tracks)))
+	return append(b, bytes.Join(tracks, nil)...)
+}
+
+func (s *S) TestParseCuesheetNonCD(c *C) {
+	cb := new(CuesheetBlock)
+	err := cb.Parse(mkCuesheet(false,
+		mkCuesheetTrack(0, 1, 0, 1000),
+		mkCuesheetTrack(48000, 255)))
+	c.Assert(err, IsNil)
+	c.Check(cb.IsCompactDisc, Equals, false)
+	c.Assert(cb.CuesheetTracks, HasLen, 2)
+	c.Check(cb.CuesheetTracks[0].CuesheetTrackIndexes[1], DeepEquals,
+		&CuesheetTrackIndexBlock{SampleOffset: 1000, IndexPoint: 2})
+	c.Check(cb.CuesheetTracks[1].TrackNumber, Equals, uint8(255))
+}
+
+func (s *S) TestParseCuesheetIndexes(c *C) {
+	// Track 1 has a two second pregap: INDEX 00 at 0 and INDEX 01 at 88200.
+	track := mkCuesheetTrack(0, 1, 0, 88200)
+	copy(track[9:], "USRC17607839")
+	track[21] = 0x40 // pre-emphasis
+	track[36+8], track[36+12+8] = 0, 1
+
+	cb := new(CuesheetBlock)
+	c.Assert(cb.Parse(mkCuesheet(true, track, mkCuesheetTrack(588*75*180, 170))), IsNil)
+	c.Assert(cb.CuesheetTracks, HasLen, 2)
+
+	ctb := cb.CuesheetTracks[0]
+	c.Check(ctb.TrackISRC, Equals, "USRC17607839")
+	c.Check(ctb.PreEmphasis, Equals, true)
+	c.Check(ctb.CuesheetTrackIndexes, DeepEquals, []*CuesheetTrackIndexBlock{
+		{SampleOffset: 0, IndexPoint: 0},
+		{SampleOffset: 88200, IndexPoint: 1}})
+	c.Check(cb.CuesheetTracks[1].TrackNumber, Equals, uint8(170))
+	c.Check(cb.CuesheetTracks[1].CuesheetTrackIndexes, HasLen, 0)
+}
+
+func (s *S) TestParseCuesheetErrors(c *C) {
+	err := new(CuesheetBlock).Parse(mkCuesheet(true, mkCuesheetTrack(0, 1, 0, 1000)))
+	c.Check(err, ErrorMatches, ".*'1000'.*must be divisible by 588.")
+
+	err = new(CuesheetBlock).Parse(mkCuesheet(false, mkCuesheetTrack(0, 0)))
+	c.Check(err, ErrorMatches, "FATAL: Cuesheet track value of 0 is not allowed.")
+
+	block := mkCuesheet(false, mkCuesheetTrack(0, 1, 0))
+	err = new(CuesheetBlock).Parse(block[:len(block)-1])
+	c.Check(err, ErrorMatches, ".*error reading CuesheetTrackIndex field.*")
+}
+
+func (s *S) TestParsePadding(c *C) {
+	pb := new(PaddingBlock)
+	c.Assert(pb.Parse(make([]byte, 16)), IsNil)
+	c.Check(pb, DeepEquals, &PaddingBlock{Length: 16, IsZero: true})
+
+	c.Assert(pb.Parse([]byte{0, 0, 1}), IsNil)
+	c.Check(pb, DeepEquals, &PaddingBlock{Length: 3, IsZero: false})
+}
+
+func (s *S) TestReadLargeMetadata(c *C) {
+	img := bytes.Repeat([]byte{0xa5}, 200000)
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPicture, false, mkPicture(3, "image/jpeg", "", img)),
+		mkBlock(MetadataPadding, true, make([]byte, 1024)))
+
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Pictures, HasLen, 1)
+	c.Check(meta.Pictures[0].Data.PictureBlob, DeepEquals, img)
+	c.Check(meta.Padding.Data.Length, Equals, uint32(1024))
+}
+
+func (s *S) TestReadErrors(c *C) {
+	_, err := ParseMetadata(bytes.NewReader([]byte("RIFF....WAVE")))
+	c.Check(errors.Is(err, ErrNotFLAC), Equals, true)
+	c.Check(err, ErrorMatches, ".*RIFF \\(WAV\\).*")
+
+	_, err = ParseMetadata(bytes.NewReader([]byte("ID3\x04\x00\x00\x00\x00\x00\x00")))
+	c.Check(err, ErrorMatches, ".*ID3v2 tag.*")
+
+	_, err = ParseMetadata(bytes.NewReader([]byte("abcdefgh")))
+	c.Check(err, ErrorMatches, "FATAL: 'abcd' is not a valid FLAC signature: not a FLAC stream")
+
+	_, err = ParseMetadata(bytes.NewReader([]byte("fL")))
+	c.Check(errors.Is(err, io.ErrUnexpectedEOF), Equals, true)
+	c.Check(errors.Is(err, ErrNotFLAC), Equals, false)
+}
+
+func (s *S) TestParseMetadataBytes(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, mkVorbisComment(3)),
+		mkBlock(MetadataBlockType(100), false, []byte("abc")),
+		mkBlock(MetadataPicture, false, mkPicture(3, "image/png", "", []byte("img"))),
+		mkBlock(MetadataPadding, true, make([]byte, 16)))
+	file := append(append([]byte(nil), stream...), 0xff, 0xf8, 0x69, 0x18)
+
+	want, err := ParseMetadata(bytes.NewReader(file))
+	c.Assert(err, IsNil)
+	meta, err := ParseMetadataBytes(file)
+	c.Assert(err, IsNil)
+	c.Check(meta, DeepEquals, want)
+	c.Check(audioOffset(c, meta), Equals, int64(len(stream)))
+
+	// Every truncation of the metadata is an error, not a panic or a read
+	// past the slice.
+	for n := 0; n < len(stream); n++ {
+		_, err := ParseMetadataBytes(stream[:n])
+		c.Check(err, NotNil, Commentf("%d bytes", n))
+	}
+	_, err = ParseMetadataBytes(stream[:len(stream)-20])
+	c.Check(errors.Is(err, ErrNoLastBlock), Equals, true)
+	_, err = ParseMetadataBytes([]byte("RIFF....WAVE"))
+	c.Check(errors.Is(err, ErrNotFLAC), Equals, true)
+
+	tag := append([]byte("ID3\x04\x00\x00\x00\x00\x00\x02"), 0, 0)
+	meta, err = ParseMetadataBytes(append(tag, stream...))
+	c.Assert(err, IsNil)
+	c.Check(meta.ID3v2Length, Equals, int64(12))
+	c.Check(audioOffset(c, meta), Equals, int64(len(tag)+len(stream)))
+
+	// Both read the same way, so an invalid ID3v2 header is the same error.
+	bad := append([]byte("ID3\x04\x00\x00\x80\x00\x00\x02"), stream...)
+	_, want2 := ParseMetadata(bytes.NewReader(bad))
+	c.Assert(want2, NotNil)
+	_, err = ParseMetadataBytes(bad)
+	c.Assert(err, NotNil)
+	c.Check(err.Error(), Equals, want2.Error())
+
+	// Block data is sliced from the input, not copied.
+	meta, err = ParseMetadataBytes(file)
+	c.Assert(err, IsNil)
+	raw := meta.Blocks[2].Raw
+	c.Check(&raw[0], Equals, &file[len(FlacSignature)+MetadataBlockHeaderLen/8*3+len(mkStreaminfo())+len(mkVorbisComment(3))])
+}
+
+// cancelReader cancels its context once n bytes have been read.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (cr *cancelReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if cr.n -= n; cr.n <= 0 {
+		cr.cancel()
+	}
+	return n, err
+}
+
+func (s *S) TestParseMetadataContext(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, mkVorbisComment(2)),
+		mkBlock(MetadataPadding, true, make([]byte, 8)))
+
+	meta, err := ParseMetadataContext(context.Background(), bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Check(meta.Blocks, HasLen, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ParseMetadataContext(ctx, bytes.NewReader(stream))
+	c.Check(err, Equals, context.Canceled)
+
+	// Cancelled while the STREAMINFO block is read: parsing stops before
+	// the block is decoded.
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = ParseMetadataContext(ctx, &cancelReader{r: bytes.NewReader(stream), n: 20, cancel: cancel})
+	c.Check(err, Equals, context.Canceled)
+}
+
+func (s *S) TestReadMaxMetadataBytes(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, false, make([]byte, 1000)),
+		mkBlock(MetadataPadding, true, make([]byte, 1000)))
+
+	meta := &Metadata{MaxMetadataBytes: 2000}
+	err := meta.Read(bytes.NewReader(stream))
+	c.Check(errors.Is(err, ErrMetadataTooLarge), Equals, true)
+	c.Check(err, ErrorMatches, "block #2 \\(PADDING\\) at offset 1046: FATAL: metadata of at least 2050 bytes is over the 2000 byte limit: metadata too large")
+
+	meta = &Metadata{MaxMetadataBytes: int64(len(stream))}
+	c.Check(meta.Read(bytes.NewReader(stream)), IsNil)
+	meta = &Metadata{MaxMetadataBytes: -1}
+	c.Check(meta.Read(bytes.NewReader(stream)), IsNil)
+
+	// The limit is checked on the header, before the block is read: a
+	// 16 MiB block over it is neither allocated nor read.
+	huge := mkStream(mkBlock(MetadataStreaminfo, false, mkStreaminfo()))
+	huge = append(huge, byte(MetadataPadding)|0x80, 0xff, 0xff, 0xff)
+	r := &countReader{r: io.MultiReader(bytes.NewReader(huge), zeroReader{})}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	meta = &Metadata{MaxMetadataBytes: 1000}
+	err = meta.Read(r)
+	runtime.ReadMemStats(&after)
+	c.Check(errors.Is(err, ErrMetadataTooLarge), Equals, true)
+	c.Check(r.n, Equals, len(huge))
+	c.Check(after.TotalAlloc-before.TotalAlloc < 1<<20, Equals, true)
+}
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func (s *S) TestReadSeveralVorbisComments(c *C) {
+	first := &VorbisCommentBlock{Vendor: "a", TotalComments: 1, Comments: []string{"TITLE=one"}}
+	second := &VorbisCommentBlock{Vendor: "b", TotalComments: 1, Comments: []string{"TITLE=two"}}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, first.Encode()),
+		mkBlock(MetadataVorbisComment, true, second.Encode()))
+
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Assert(meta.VorbisComments, HasLen, 2)
+	c.Check(meta.PrimaryComments(), DeepEquals, first)
+	c.Check(meta.VorbisComment.Data, DeepEquals, first)
+	c.Check(meta.VorbisComments[1].Data, DeepEquals, second)
+	c.Check(meta.VorbisComments[1].Header, Equals, meta.Blocks[2].Header)
+
+	var buf bytes.Buffer
+	_, err = meta.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	c.Check(buf.Bytes(), DeepEquals, stream)
+	c.Check(meta.VorbisCommentOf(meta.Blocks[2].Header), Equals, meta.VorbisComments[1].Data)
+
+	// PrimaryComments is what WriteTo writes, even once VorbisComment.Data
+	// is replaced.
+	third := &VorbisCommentBlock{Vendor: "c", TotalComments: 1, Comments: []string{"TITLE=three"}}
+	meta.VorbisComment.Data = third
+	c.Check(meta.PrimaryComments(), Equals, third)
+	buf.Reset()
+	_, err = meta.WriteTo(&buf)
+	c.Assert(err, IsNil)
+	meta, err = ParseMetadata(&buf)
+	c.Assert(err, IsNil)
+	c.Check(meta.PrimaryComments(), DeepEquals, third)
+
+	c.Check(new(Metadata).PrimaryComments(), IsNil)
+}
+
+func (s *S) TestParseStreamInfo(c *C) {
+	vc := mkBlock(MetadataVorbisComment, true, mkVorbisComment(2))
+	r := bytes.NewReader(mkStream(mkBlock(MetadataStreaminfo, false, mkStreaminfo()), vc))
+	sib, err := ParseStreamInfo(r)
+	c.Assert(err, IsNil)
+	c.Check(sib.SampleRate, Equals, uint32(44100))
+	c.Check(sib.TotalSamples, Equals, uint64(1014300))
+	c.Check(r.Len(), Equals, len(vc))
+
+	_, err = ParseStreamInfo(bytes.NewReader(mkStream(vc)))
+	c.Check(errors.Is(err, ErrMissingStreamInfo), Equals, true)
+	_, err = ParseStreamInfo(bytes.NewReader([]byte("fLaC")))
+	c.Check(errors.Is(err, ErrTruncatedFile), Equals, true)
+}
+
+func (s *S) TestReadID3v2Prefix(c *C) {
+	// A 20 byte tag with a footer: 10 byte header, 20 bytes, 10 byte footer.
+	tag := append([]byte("ID3\x04\x00\x10\x00\x00\x00\x14"), make([]byte, 30)...)
+	stream := mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	file := append(tag, stream...)
+
+	meta, err := ParseMetadata(bytes.NewReader(file))
+	c.Assert(err, IsNil)
+	c.Check(meta.ID3v2Length, Equals, int64(40))
+	c.Check(meta.Blocks[0].Offset, Equals, int64(44))
+	c.Check(audioOffset(c, meta), Equals, int64(len(file)))
+
+	// An MP3 file: the tag is followed by MPEG audio, not "fLaC".
+	mp3 := append(append([]byte(nil), tag...), 0xFF, 0xFB, 0x90, 0x00)
+	_, err = ParseMetadata(bytes.NewReader(mp3))
+	c.Check(errors.Is(err, ErrNotFLAC), Equals, true)
+	c.Check(err, ErrorMatches, ".*MP3 audio.*")
+
+	_, err = ParseMetadata(bytes.NewReader(file[:20]))
+	c.Check(errors.Is(err, ErrTruncatedFile), Equals, true)
+}
+
+func (s *S) TestParseVorbisCommentCorrupt(c *C) {
+	block := mkVorbisComment(2)
+
+	// A comment count far larger than the data supports.
+	b := append([]byte(nil), block...)
+	b[36] = 0xff
+	c.Check(new(VorbisCommentBlock).Parse(b), ErrorMatches, "FATAL: 255 comments declared but only room for .*")
+
+	// A comment length that runs past the end of the block.
+	c.Check(new(VorbisCommentBlock).Parse(block[:len(block)-3]), ErrorMatches,
+		"FATAL: error reading comment 2 of 2. Expected 34 byte.*, got 31.")
+
+	c.Check(new(VorbisCommentBlock).Parse(block[:10]), ErrorMatches, "FATAL: error reading Vendor field.*")
+	c.Check(new(VorbisCommentBlock).Parse(nil), ErrorMatches, "FATAL: error reading VendorLength field.*")
+
+	// Lengths and counts with the top bit set, negative as a 32 bit int.
+	b = append([]byte(nil), block...)
+	binary.LittleEndian.PutUint32(b, 0xfffffff0)
+	c.Check(new(VorbisCommentBlock).Parse(b), ErrorMatches, "FATAL: error reading Vendor field. Expected 4294967280 byte.*")
+	b = append([]byte(nil), block...)
+	binary.LittleEndian.PutUint32(b[36:], 0x80000000)
+	c.Check(new(VorbisCommentBlock).Parse(b), ErrorMatches, "FATAL: 2147483648 comments declared but only room for .*")
+	b = append([]byte(nil), block...)
+	binary.LittleEndian.PutUint32(b[40:], 0x80000000)
+	c.Check(new(VorbisCommentBlock).Parse(b), ErrorMatches, "FATAL: error reading comment 1 of 2. Expected 2147483648 byte.*")
+}
+
+func (s *S) TestVorbisCommentTags(c *C) {
+	vcb := &VorbisCommentBlock{Comments: []string{
+		"artist=piman",
+		"ARTIST=jzig",
+		"Title=Silence",
+		"junk",
+		"EMPTY="}}
+	c.Check(vcb.Tags(), DeepEquals, map[string][]string{
+		"ARTIST": {"piman", "jzig"},
+		"TITLE":  {"Silence"},
+		"EMPTY":  {""},
+		"":       {"junk"}})
+}
+
+func (s *S) TestVorbisCommentGet(c *C) {
+	vcb := &VorbisCommentBlock{Comments: []string{"artist=piman", "ARTIST=jzig", "title="}}
+
+	v, ok := vcb.Get("Artist")
+	c.Check(v, Equals, "piman")
+	c.Check(ok, Equals, true)
+
+	v, ok = vcb.Get("TITLE")
+	c.Check(v, Equals, "")
+	c.Check(ok, Equals, true)
+
+	_, ok = vcb.Get("ALBUM")
+	c.Check(ok, Equals, false)
+}
+
+func (s *S) TestVorbisCommentCountMatching(c *C) {
+	vcb := &VorbisCommentBlock{Comments: []string{"artist=piman", "ARTIST=jzig", "title=", "junk", "ALBUM="}}
+	isArtist := func(key, value string) bool { return strings.EqualFold(key, "ARTIST") }
+	isEmpty := func(key, value string) bool { return value == "" }
+	c.Check(vcb.CountMatching(isArtist), Equals, 2)
+	c.Check(vcb.CountMatching(isEmpty), Equals, 2)
+	c.Check(vcb.CountMatching(func(key, value string) bool { return key == "" && value == "junk" }), Equals, 1)
+	c.Check(new(VorbisCommentBlock).CountMatching(isEmpty), Equals, 0)
+	c.Check(testing.AllocsPerRun(10, func() { vcb.CountMatching(isArtist) }), Equals, 0.0)
+}
+
+func (s *S) TestVorbisCommentEdit(c *C) {
+	vcb := &VorbisCommentBlock{
+		TotalComments: 4,
+		Comments:      []string{"artist=piman", "TITLE=a", "ARTIST=jzig", "notag"}}
+
+	vcb.Set("Artist", "bob")
+	c.Check(vcb.Comments, DeepEquals, []string{"Artist=bob", "TITLE=a", "notag"})
+	c.Check(vcb.TotalComments, Equals, uint32(3))
+
+	vcb.Add("artist", "alice")
+	vcb.Set("ALBUM", "x")
+	c.Check(vcb.Comments, DeepEquals, []string{"Artist=bob", "TITLE=a", "notag", "artist=alice", "ALBUM=x"})
+	c.Check(vcb.TotalComments, Equals, uint32(5))
+
+	vcb.Remove("ARTIST")
+	c.Check(vcb.Comments, DeepEquals, []string{"TITLE=a", "notag", "ALBUM=x"})
+	c.Check(vcb.TotalComments, Equals, uint32(3))
+}
+
+func (s *S) TestVorbisCommentSuspiciousTags(c *C) {
+	vcb := &VorbisCommentBlock{Comments: []string{
+		"TITLE=ok",
+		"ARTIST=nul\x00",
+		"COMMENT=two\nlines\tand a tab",
+		"ALBUM=\x1bescape",
+		"DATE=2012\r"}}
+	c.Check(vcb.SuspiciousTags(), DeepEquals, []string{"ARTIST=nul\x00", "ALBUM=\x1bescape", "DATE=2012\r"})
+
+	vcb.Comments = vcb.Comments[:1]
+	c.Check(vcb.SuspiciousTags(), IsNil)
+}
+
+func (s *S) TestVorbisCommentValidateUTF8(c *C) {
+	vcb := &VorbisCommentBlock{Vendor: "libFLAC", Comments: []string{"TITLE=Caf\u00e9", "ARTIST=Bj\xf6rk", "ALBUM=ok", "X=\xff"}}
+	c.Check(vcb.ValidateUTF8(), ErrorMatches, "FATAL: invalid UTF-8 in comment\\[1\\], comment\\[3\\].")
+
+	vcb = &VorbisCommentBlock{Vendor: "\xe9", Comments: []string{"TITLE=a"}}
+	c.Check(vcb.ValidateUTF8(), ErrorMatches, "FATAL: invalid UTF-8 in vendor string.")
+
+	vcb.Vendor = "libFLAC"
+	c.Check(vcb.ValidateUTF8(), IsNil)
+}
+
+func (s *S) TestStreaminfoValidate(c *C) {
+	sib := new(StreaminfoBlock)
+	c.Assert(sib.Parse(mkStreaminfo()), IsNil)
+	c.Check(sib.Validate(), IsNil)
+
+	bad := *sib
+	bad.BitsPerSample = 3
+	c.Check(bad.Validate(), ErrorMatches, "FATAL: invalid BitsPerSample: 3.*")
+
+	bad = *sib
+	bad.Channels = 0
+	c.Check(bad.Validate(), ErrorMatches, "FATAL: invalid Channels: 0.*")
+
+	bad = *sib
+	bad.MinFrameSize, bad.MaxFrameSize = 20, 10
+	c.Check(bad.Validate(), ErrorMatches, "FATAL: MinFrameSize '20' is larger.*")
+
+	bad = *sib
+	bad.MinFrameSize = 0
+	c.Check(bad.Validate(), IsNil)
+
+	block := mkStreaminfo()
+	block[10], block[11] = 0, 0 // zero the 20 bit sample rate
+	block[12] &= 0x0f
+	c.Check(new(StreaminfoBlock).Parse(block), ErrorMatches, "FATAL: invalid SampleRate: .*")
+
+	block = mkStreaminfo()
+	block[2], block[3] = 0, 15 // a 15 sample maximum block size
+	c.Check(new(StreaminfoBlock).Parse(block), ErrorMatches, "FATAL: invalid MaxBlockSize '15'. Must be >= 16.")
+
+	// Parse leaves inconsistent sizes to Validate.
+	block = mkStreaminfo()
+	binary.BigEndian.PutUint16(block[0:2], 4608)
+	binary.BigEndian.PutUint16(block[2:4], 1152)
+	sib = new(StreaminfoBlock)
+	c.Check(sib.Parse(block), IsNil)
+	c.Check(sib.Validate(), ErrorMatches, "FATAL: MinBlockSize '4608' is larger than MaxBlockSize '1152'.")
+
+	c.Check(new(StreaminfoBlock).Parse(mkStreaminfo()[:20]), ErrorMatches, "FATAL: error reading MD5Signature field.*")
+}
+
+func (s *S) TestStreaminfoMD5(c *C) {
+	sib := new(StreaminfoBlock)
+	c.Assert(sib.Parse(mkStreaminfo()), IsNil)
+	c.Check(sib.HasMD5(), Equals, true)
+	sum := []byte{0xe5, 0xcc, 0xc9, 0x67, 0xce, 0xd6, 0xc1, 0x11,
+		0x53, 0x0e, 0x5c, 0x79, 0xe3, 0x3c, 0x96, 0x9e}
+	c.Check(sib.MD5Matches(sum), Equals, true)
+	c.Check(sib.MD5Matches(sum[:15]), Equals, false)
+	c.Check(sib.MD5.String(), Equals, "e5ccc967ced6c111530e5c79e33c969e")
+	c.Check(sib.MD5Signature, Equals, sib.MD5.String())
+
+	sib.MD5 = MD5Sum{}
+	c.Check(sib.HasMD5(), Equals, false)
+	c.Check(sib.MD5Matches(make([]byte, 16)), Equals, false)
+}
+
+func (s *S) TestMD5SumText(c *C) {
+	sum := MD5Sum{0xe5, 0xcc, 0xc9, 0x67, 0xce, 0xd6, 0xc1, 0x11,
+		0x53, 0x0e, 0x5c, 0x79, 0xe3, 0x3c, 0x96, 0x9e}
+	b, err := json.Marshal(map[string]MD5Sum{"md5": sum})
+	c.Assert(err, IsNil)
+	c.Check(string(b), Equals, `{"md5":"e5ccc967ced6c111530e5c79e33c969e"}`)
+
+	var got map[string]MD5Sum
+	c.Assert(json.Unmarshal(b, &got), IsNil)
+	c.Check(got["md5"], Equals, sum)
+
+	var upper MD5Sum
+	c.Check(upper.UnmarshalText([]byte("E5CCC967CED6C111530E5C79E33C969E")), IsNil)
+	c.Check(upper, Equals, sum)
+	c.Check(upper.UnmarshalText([]byte("e5cc")), ErrorMatches, "FATAL: MD5 signature must be 32 hex digits, got 4.")
+	c.Check(upper.UnmarshalText([]byte("e5ccc967ced6c111530e5c79e33c969e0")), ErrorMatches, "FATAL: MD5 signature must be 32 hex digits, got 33.")
+	c.Check(upper.UnmarshalText([]byte("zzccc967ced6c111530e5c79e33c969e")), ErrorMatches, "FATAL: invalid MD5 signature .*")
+	c.Check(upper, Equals, sum)
+}
+
+func (s *S) TestStreaminfoIsFixedBlockSize(c *C) {
+	c.Check((&StreaminfoBlock{MinBlockSize: 4096, MaxBlockSize: 4096}).IsFixedBlockSize(), Equals, true)
+	c.Check((&StreaminfoBlock{MinBlockSize: 1152, MaxBlockSize: 4608}).IsFixedBlockSize(), Equals, false)
+}
+
+func (s *S) TestStreaminfoChannelsAndBitsPerSample(c *C) {
+	c.Check(StreaminfoChannelCountMaximum, Equals, 8)
+	c.Check(StreaminfoBitsPerSampleMaximum, Equals, 32)
+
+	// The 3 bit channel count and 5 bit sample size sit between the sample
+	// rate and the total samples; the neighbouring bits are set to all
+	// zeros and then all ones, as far as Validate allows, to catch a field
+	// reading bits of the next.
+	for _, n := range []struct {
+		rate  uint32
+		total uint64
+	}{{1, 0}, {655349, StreaminfoTotalSamplesMaximum - 1}} {
+		for channels := uint8(1); channels <= 8; channels++ {
+			for bits := uint8(4); bits <= 32; bits++ {
+				block := mkStreaminfo()
+				binary.BigEndian.PutUint64(block[10:18], uint64(n.rate)<<44|
+					uint64(channels-1)<<41|uint64(bits-1)<<36|n.total)
+				sib := new(StreaminfoBlock)
+				comment := Commentf("%d channels, %d bits, block % x", channels, bits, block)
+				c.Assert(sib.Parse(block), IsNil, comment)
+				c.Check(sib.SampleRate, Equals, n.rate, comment)
+				c.Check(sib.Channels, Equals, channels, comment)
+				c.Check(sib.BitsPerSample, Equals, bits, comment)
+				c.Check(sib.TotalSamples, Equals, n.total, comment)
+				c.Check(sib.encode(), DeepEquals, block, comment)
+			}
+		}
+	}
+
+	sib := new(StreaminfoBlock)
+	block := mkStreaminfo()
+	word := binary.BigEndian.Uint64(block[10:18])
+	binary.BigEndian.PutUint64(block[10:18], word&^(0x1F<<36)|2<<36) // 3 bits per sample
+	c.Check(sib.Parse(block), IsNil)
+	c.Check(sib.BitsPerSample, Equals, uint8(3))
+	c.Check(sib.Validate(), ErrorMatches, "FATAL: invalid BitsPerSample: 3. Must be between 4 and 32.")
+}
+
+func (s *S) TestStreaminfoIsHighResolution(c *C) {
+	for _, t := range []struct {
+		rate uint32
+		bits uint8
+		hi   bool
+	}{{44100, 16, false}, {48000, 16, false}, {8000, 8, false}, {44100, 24, true}, {48000, 17, true}, {48001, 16, true}, {96000, 16, true}, {192000, 24, true}} {
+		sib := &StreaminfoBlock{SampleRate: t.rate, BitsPerSample: t.bits}
+		c.Check(sib.IsHighResolution(), Equals, t.hi, Commentf("%d Hz, %d bits", t.rate, t.bits))
+	}
+}
+
+func (s *S) TestStreaminfoDecodedSize(c *C) {
+	for _, t := range []struct {
+		bits uint8
+		size int64
+	}{{8, 2000}, {12, 4000}, {16, 4000}, {20, 6000}, {24, 6000}, {32, 8000}} {
+		n, ok := (&StreaminfoBlock{TotalSamples: 1000, Channels: 2, BitsPerSample: t.bits}).DecodedSize()
+		c.Check(ok, Equals, true)
+		c.Check(n, Equals, t.size, Commentf("%d bits", t.bits))
+	}
+	_, ok := (&StreaminfoBlock{Channels: 2, BitsPerSample: 16}).DecodedSize()
+	c.Check(ok, Equals, false)
+}
+
+func (s *S) TestStreaminfoChannelLayout(c *C) {
+	c.Check((&StreaminfoBlock{Channels: 1}).ChannelLayout(), Equals, "mono")
+	c.Check((&StreaminfoBlock{Channels: 6}).ChannelLayout(), Matches, "5.1 \\(.*LFE.*\\)")
+	c.Check((&StreaminfoBlock{Channels: 0}).ChannelLayout(), Equals, "unknown")
+	c.Check((&StreaminfoBlock{Channels: 9}).ChannelLayout(), Equals, "unknown")
+}
+
+func (s *S) TestStreaminfoDuration(c *C) {
+	sib := &StreaminfoBlock{SampleRate: 44100, TotalSamples: 1014300}
+	d, ok := sib.Duration()
+	c.Check(ok, Equals, true)
+	c.Check(d, Equals, 23*time.Second)
+
+	sib = &StreaminfoBlock{SampleRate: 48000, TotalSamples: 1<<36 - 1}
+	d, _ = sib.Duration()
+	c.Check(d, Equals, time.Duration((1<<36-1)*(int64(time.Second)/1000)/48))
+
+	sib.TotalSamples = 0
+	_, ok = sib.Duration()
+	c.Check(ok, Equals, false)
+}
+
+func (s *S) TestParseMetadataLeavesAudio(c *C) {
+	audio := []byte{0xff, 0xf8, 0x69, 0x08}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, true, make([]byte, 4)))
+	r := io.MultiReader(bytes.NewReader(stream), bytes.NewReader(audio))
+
+	_, err := ParseMetadata(r)
+	c.Assert(err, IsNil)
+	rest, err := io.ReadAll(r)
+	c.Assert(err, IsNil)
+	c.Check(rest, DeepEquals, audio)
+}
+
+func (s *S) TestMetadataBlockHeaderString(c *C) {
+	mbh := &MetadataBlockHeader{Type: MetadataVorbisComment, Length: 57, Last: true}
+	c.Check(mbh.String(), Equals, "type: 4 (VORBIS_COMMENT)\nis last: true\nlength: 57")
+}
+
+func (s *S) TestStreaminfoString(c *C) {
+	sib := new(StreaminfoBlock)
+	c.Assert(sib.Parse(mkStreaminfo()), IsNil)
+	c.Check(sib.String(), Equals, `minimum blocksize: 4096 samples
+maximum blocksize: 4096 samples
+minimum framesize: 11 bytes
+maximum framesize: 14 bytes
+sample_rate: 44100 Hz
+channels: 1
+bits-per-sample: 16
+total samples: 1014300
+MD5 signature: e5ccc967ced6c111530e5c79e33c969e`)
+}
+
+func (s *S) TestReadTruncatedBlock(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, true, make([]byte, 40)))
+
+	_, err := ParseMetadata(bytes.NewReader(stream[:len(stream)-15]))
+	c.Check(errors.Is(err, ErrTruncatedBlock), Equals, true)
+	c.Check(err, ErrorMatches, ".*: FATAL: VORBIS_COMMENT metadata block is 15 byte\\(s\\) short: .*")
+}
+
+func (s *S) TestBlockOffsets(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataApplication, false, []byte("test1234")),
+		mkBlock(MetadataPadding, true, make([]byte, 100)))
+
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Blocks, HasLen, 3)
+	c.Check(meta.Blocks[0].Offset, Equals, int64(4))
+	c.Check(meta.Blocks[0].Len(), Equals, int64(38))
+	c.Check(meta.Blocks[1].Offset, Equals, int64(42))
+	c.Check(meta.Blocks[1].Len(), Equals, int64(12))
+	c.Check(meta.Blocks[2].Offset, Equals, int64(54))
+	c.Check(meta.Blocks[2].Offset+meta.Blocks[2].Len(), Equals, int64(len(stream)))
+	c.Check(meta.MetadataLength(), Equals, int64(len(stream)))
+	c.Check(meta.BlockTypes(), DeepEquals, []string{"STREAMINFO", "APPLICATION", "PADDING"})
+	c.Check(meta.BlockCount(), Equals, 3)
+	c.Check(new(Metadata).MetadataLength(), Equals, int64(0))
+	c.Check(new(Metadata).BlockCount(), Equals, 0)
+}
+
+// audioOffset returns meta.AudioOffset, failing the test if it is unknown.
+func audioOffset(c *C, meta *Metadata) int64 {
+	off, ok := meta.AudioOffset()
+	c.Assert(ok, Equals, true)
+	return off
+}
+
+func (s *S) TestAudioReader(c *C) {
+	audio := []byte{0xff, 0xf8, 0x69, 0x08, 0x00}
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPadding, true, make([]byte, 10)))
+	r := bytes.NewReader(append(stream, audio...))
+
+	meta, err := ParseMetadata(r)
+	c.Assert(err, IsNil)
+	c.Check(audioOffset(c, meta), Equals, int64(len(stream)))
+
+	ar, err := meta.AudioReader(r)
+	c.Assert(err, IsNil)
+	b, err := io.ReadAll(ar)
+	c.Assert(err, IsNil)
+	c.Check(b, DeepEquals, audio)
+}
+
+func (s *S) TestAverageBitrate(c *C) {
+	stream := mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	// 1014300 samples at 44100 Hz is 23 seconds; 2875000 bytes of audio in
+	// that time is 1000 kbit/s.
+	kbps, ok := meta.AverageBitrate(int64(len(stream)) + 2875000)
+	c.Check(ok, Equals, true)
+	c.Check(kbps, Equals, 1000)
+
+	_, ok = meta.AverageBitrate(int64(len(stream)))
+	c.Check(ok, Equals, false)
+
+	meta.Streaminfo.Data.TotalSamples = 0
+	_, ok = meta.AverageBitrate(1 << 20)
+	c.Check(ok, Equals, false)
+	_, ok = new(Metadata).AverageBitrate(1 << 20)
+	c.Check(ok, Equals, false)
+}
+
+func (s *S) TestMetadataEqual(c *C) {
+	parse := func(blocks ...[]byte) *Metadata {
+		meta, err := ParseMetadata(bytes.NewReader(mkStream(blocks...)))
+		c.Assert(err, IsNil)
+		return meta
+	}
+	vc := func(comments ...string) []byte {
+		return (&VorbisCommentBlock{Vendor: "test", Comments: comments}).Encode()
+	}
+	si := mkBlock(MetadataStreaminfo, false, mkStreaminfo())
+	pic := mkBlock(MetadataPicture, false, mkPicture(3, "image/png", "", []byte("img")))
+
+	a := parse(si, mkBlock(MetadataVorbisComment, false, vc("ARTIST=A", "ARTIST=B", "TITLE=T")), pic,
+		mkBlock(MetadataPadding, true, make([]byte, 100)))
+	b := parse(si, pic, mkBlock(MetadataVorbisComment, true, vc("title=T", "ARTIST=A", "artist=B")))
+	c.Check(a.Equal(b), Equals, true)
+	c.Check(b.Equal(a), Equals, true)
+
+	c.Check(a.Equal(parse(si, pic, mkBlock(MetadataVorbisComment, true, vc("ARTIST=B", "ARTIST=A", "TITLE=T")))), Equals, false)
+	c.Check(a.Equal(parse(si, pic, mkBlock(MetadataVorbisComment, true, vc("ARTIST=A", "ARTIST=B")))), Equals, false)
+	c.Check(a.Equal(parse(si, mkBlock(MetadataVorbisComment, true, vc("ARTIST=A", "ARTIST=B", "TITLE=T")))), Equals, false)
+	c.Check(a.Equal(parse(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))), Equals, false)
+
+	b.Streaminfo.Data.TotalSamples++
+	c.Check(a.Equal(b), Equals, false)
+}
+
+func (s *S) TestVorbisCommentReplayGain(c *C) {
+	vcb := &VorbisCommentBlock{Comments: []string{
+		"REPLAYGAIN_TRACK_GAIN=-6.54 dB",
+		"replaygain_track_peak=0.988",
+		"REPLAYGAIN_ALBUM_GAIN=+1.20dB",
+		"REPLAYGAIN_ALBUM_PEAK=loud",
+	}}
+	rg, ok := vcb.ReplayGain()
+	c.Check(ok, Equals, true)
+	c.Check(rg, DeepEquals, ReplayGain{
+		TrackGain: -6.54, HasTrackGain: true,
+		TrackPeak: 0.988, HasTrackPeak: true,
+		AlbumGain: 1.2, HasAlbumGain: true,
+	})
+
+	_, ok = (&VorbisCommentBlock{Comments: []string{"TITLE=x"}}).ReplayGain()
+	c.Check(ok, Equals, false)
+	_, ok = (&VorbisCommentBlock{Comments: []string{"REPLAYGAIN_TRACK_GAIN=loud"}}).ReplayGain()
+	c.Check(ok, Equals, false)
+}
+
+func (s *S) TestVorbisCommentAddReplayGainPlaceholders(c *C) {
+	vcb := &VorbisCommentBlock{Comments: []string{"TITLE=x", "replaygain_track_gain=-3.00 dB"}, TotalComments: 2}
+	c.Check(vcb.AddReplayGainPlaceholders(), Equals, true)
+	c.Check(vcb.Comments, DeepEquals, []string{
+		"TITLE=x",
+		"replaygain_track_gain=-3.00 dB",
+		"REPLAYGAIN_TRACK_PEAK=0.000000",
+		"REPLAYGAIN_ALBUM_GAIN=+0.00 dB",
+		"REPLAYGAIN_ALBUM_PEAK=0.000000",
+	})
+	c.Check(vcb.TotalComments, Equals, uint32(5))
+
+	c.Check(vcb.AddReplayGainPlaceholders(), Equals, false)
+	c.Check(vcb.Comments, HasLen, 5)
+}
+
+func (s *S) TestWalkMetadata(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPicture, false, mkPicture(3, "image/png", "", []byte("a"))),
+		mkBlock(MetadataPicture, false, mkPicture(4, "image/png", "", []byte("b"))),
+		mkBlock(MetadataPadding, true, make([]byte, 8)))
+
+	var types []MetadataBlockType
+	err := WalkMetadata(bytes.NewReader(stream), func(mbh *MetadataBlockHeader, block []byte) error {
+		c.Check(block, HasLen, int(mbh.Length))
+		types = append(types, mbh.Type)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Check(types, DeepEquals, []MetadataBlockType{MetadataStreaminfo, MetadataPicture, MetadataPicture, MetadataPadding})
+
+	stop := errors.New("stop")
+	pictures := 0
+	err = WalkMetadata(bytes.NewReader(stream), func(mbh *MetadataBlockHeader, block []byte) error {
+		if mbh.Type == MetadataPicture {
+			pictures++
+			return stop
+		}
+		return nil
+	})
+	c.Check(err, Equals, stop)
+	c.Check(pictures, Equals, 1)
+}
+
+func (s *S) TestReadTruncatedFile(c *C) {
+	for _, stream := range [][]byte{nil, []byte("fL"), []byte("fLaC"), []byte("fLaC\x00\x00")} {
+		_, err := ParseMetadata(bytes.NewReader(stream))
+		c.Check(errors.Is(err, ErrTruncatedFile), Equals, true, Commentf("stream %q: %v", stream, err))
+	}
+}
+
+func (s *S) TestReadNoLastBlock(c *C) {
+	stream := mkStream(mkBlock(MetadataStreaminfo, false, mkStreaminfo()))
+	_, err := ParseMetadata(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, "FATAL: end of file after 1 metadata block.*")
+	c.Check(errors.Is(err, ErrNoLastBlock), Equals, true)
+	c.Check(errors.Is(err, ErrTruncatedFile), Equals, true)
+
+	stream = append(stream, 0xff, 0xf8, 0x69, 0x08, 0x00, 0x00)
+	_, err = ParseMetadata(bytes.NewReader(stream))
+	c.Check(err, ErrorMatches, "FATAL: audio frame found after 1 metadata block.*")
+	c.Check(errors.Is(err, ErrNoLastBlock), Equals, true)
+}
+
+func (s *S) TestStreaminfoLargeMaxBlockSize(c *C) {
+	block := mkStreaminfo()
+	block[2], block[3] = 0xff, 0xff              // MaxBlockSize 65535
+	block[4], block[5], block[6] = 0, 0x12, 0x34 // MinFrameSize 0x1234
+	block[7], block[8], block[9] = 0, 0x56, 0x78 // MaxFrameSize 0x5678
+
+	sib := new(StreaminfoBlock)
+	c.Assert(sib.Parse(block), IsNil)
+	c.Check(sib.MaxBlockSize, Equals, uint16(65535))
+	c.Check(sib.MinFrameSize, Equals, uint32(0x1234))
+	c.Check(sib.MaxFrameSize, Equals, uint32(0x5678))
+}
+
+// mkVorbisComment returns a Vorbis comment block with n comments.
+func mkVorbisComment(n int) []byte {
+	vcb := &VorbisCommentBlock{Vendor: "reference libFLAC 1.2.1 20070917"}
+	for i := 0; i < n; i++ {
+		vcb.Comments = append(vcb.Comments, fmt.Sprintf("MUSICBRAINZ_TAG_%d=0123456789abcdef", i))
+	}
+	return vcb.Encode()
+}
+
+func (s *S) BenchmarkParseVorbisComment(c *C) {
+	block := mkVorbisComment(500)
+	c.SetBytes(int64(len(block)))
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		vcb := new(VorbisCommentBlock)
+		if err := vcb.Parse(block); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+// parseFiles parses each of files with ParseMetadata, using the given number
+// of goroutines.
+func parseFiles(files [][]byte, workers int) error {
+	jobs := make(chan []byte)
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			var err error
+			for f := range jobs {
+				if _, e := ParseMetadata(bytes.NewReader(f)); e != nil && err == nil {
+					err = e
+				}
+			}
+			errs <- err
+		}()
+	}
+	for _, f := range files {
+		jobs <- f
+	}
+	close(jobs)
+
+	var err error
+	for i := 0; i < workers; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// mkLibrary returns n FLAC streams with tags and a picture, as in a music
+// library.
+func mkLibrary(n int) [][]byte {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, false, mkVorbisComment(20)),
+		mkBlock(MetadataPicture, false, mkPicture(3, "image/png", "", make([]byte, 4096))),
+		mkBlock(MetadataPadding, true, make([]byte, 1024)))
+	files := make([][]byte, n)
+	for i := range files {
+		files[i] = stream
+	}
+	return files
+}
+
+func (s *S) BenchmarkParseSerial(c *C) {
+	files := mkLibrary(100)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if err := parseFiles(files, 1); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+func (s *S) BenchmarkParseParallel(c *C) {
+	files := mkLibrary(100)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if err := parseFiles(files, runtime.GOMAXPROCS(0)); err != nil {
+			c.Fatal(err)
+		}
+	}
+}
+
+// ParseMetadata keeps no shared state, so a directory of files can be
+// parsed by a pool of goroutines.
+func ExampleParseMetadata_concurrent() {
+	files := [][]byte{
+		mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo())),
+		mkStream(
+			mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+			mkBlock(MetadataPadding, true, make([]byte, 16))),
+		[]byte("RIFF....WAVE"),
+	}
+
+	results := make([]string, len(files))
+	var wg sync.WaitGroup
+	for i, f := range files {
+		wg.Add(1)
+		go func(i int, f []byte) {
+			defer wg.Done()
+			meta, err := ParseMetadata(bytes.NewReader(f))
+			if err != nil {
+				results[i] = "error: " + err.Error()
+				return
+			}
+			results[i] = fmt.Sprint(meta.BlockTypes())
+		}(i, f)
+	}
+	wg.Wait()
+
+	for _, r := range results {
+		fmt.Println(r)
+	}
+	// Output:
+	// [STREAMINFO]
+	// [STREAMINFO PADDING]
+	// error: FATAL: 'RIFF' is not a valid FLAC signature; the file starts with a RIFF (WAV) file: not a FLAC stream
+}
+
+// ParseMetadata only ever reads r sequentially and never seeks, so the
+// metadata of a compressed FLAC file can be read from a decompressing
+// reader without first writing the file out.
+func ExampleParseMetadata_gzip() {
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	zw.Write(mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataVorbisComment, true, (&VorbisCommentBlock{Vendor: "v", Comments: []string{"TITLE=Silence"}}).Encode())))
+	zw.Close()
+
+	zr, err := gzip.NewReader(&archive)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer zr.Close()
+	meta, err := ParseMetadata(zr)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	title, _ := meta.VorbisComment.Data.Get(CommentTitle)
+	fmt.Println(meta.Streaminfo.Data.SampleRate, title)
+	// Output:
+	// 44100 Silence
+}
@@ -0,0 +1,341 @@
+// frame.go - Parsing of FLAC audio frame headers.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package flac
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// FrameSyncCode is the 14 bit code every frame header starts with.
+	FrameSyncCode = 0x3FFE
+
+	// FrameHeaderMaxLen is the longest a frame header can be, in bytes:
+	// sync and flags, a 7 byte coded number, a 16 bit block size, a 16
+	// bit sample rate and the CRC-8.
+	FrameHeaderMaxLen = 16
+)
+
+// ErrFrameHeaderCRC is returned, wrapped, when the CRC-8 stored at the end of
+// a frame header does not match the header bytes.
+var ErrFrameHeaderCRC = errors.New("frame header CRC mismatch")
+
+// ErrSampleRateMismatch is returned, wrapped, when a frame header codes a
+// sample rate other than the one in STREAMINFO.
+var ErrSampleRateMismatch = errors.New("frame sample rate does not match STREAMINFO")
+
+// FrameHeader is the header of an audio frame. A BlockSize, SampleRate or
+// BitsPerSample of 0 means the value is not coded in the frame header and
+// comes from the StreaminfoBlock. Number is the frame number, or the number
+// of the first sample in the frame when VariableBlockSize is set.
+type FrameHeader struct {
+	VariableBlockSize bool
+	BlockSize         uint32
+	SampleRate        uint32
+	ChannelAssignment uint8
+	Channels          uint8
+	BitsPerSample     uint8
+	Number            uint64
+	CRC8              uint8
+	Length            int
+}
+
+// frameSampleRates are the sample rates, in Hz, of the sample rate codes
+// that do not need trailing bits. 0 means the rate is in STREAMINFO.
+var frameSampleRates = [12]uint32{
+	0, 88200, 176400, 192000, 8000, 16000, 22050, 24000, 32000, 44100, 48000, 96000,
+}
+
+// frameSampleSizes are the bits per sample of each sample size code. Code 3
+// is reserved.
+var frameSampleSizes = [8]uint8{0, 8, 12, 0, 16, 20, 24, 32}
+
+// crc8 computes the CRC-8 of a frame header, with polynomial
+// x^8 + x^2 + x^1 + x^0 and an initial value of 0.
+func crc8(b []byte) uint8 {
+	var crc uint8
+	for _, x := range b {
+		crc ^= x
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// readCodedNumber decodes the UTF-8 style coded number at the start of b,
+// which holds up to 36 bits in 1 to 7 bytes, and returns it with its length.
+func readCodedNumber(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, fmt.Errorf("FATAL: frame header ends before its coded number.")
+	}
+	n := 0
+	for n < 8 && b[0]&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	switch {
+	case n == 0:
+		return uint64(b[0]), 1, nil
+	case n == 1 || n == 8:
+		return 0, 0, fmt.Errorf("FATAL: invalid coded number lead byte 0x%02x.", b[0])
+	}
+	if len(b) < n {
+		return 0, 0, fmt.Errorf("FATAL: coded number is %d byte(s), got %d.", n, len(b))
+	}
+	v := uint64(b[0] & (0x7F >> uint(n)))
+	for _, c := range b[1:n] {
+		if c&0xC0 != 0x80 {
+			return 0, 0, fmt.Errorf("FATAL: invalid coded number continuation byte 0x%02x.", c)
+		}
+		v = v<<6 | uint64(c&0x3F)
+	}
+	return v, n, nil
+}
+
+// Parse parses the frame header at the start of b and checks its CRC-8. b
+// may extend past the header; Length is set to the bytes the header used.
+func (fh *FrameHeader) Parse(b []byte) error {
+	// http://flac.sourceforge.net/format.html#frame_header
+	// Field Len  | Data
+	// -----------+--------------------------------------------------------
+	// 14         | Sync code '11111111111110'
+	// 1          | Reserved, must be 0.
+	// 1          | Blocking strategy: 0 fixed-blocksize, 1 variable-blocksize.
+	// 4          | Block size in inter-channel samples.
+	// 4          | Sample rate.
+	// 4          | Channel assignment.
+	// 3          | Sample size in bits.
+	// 1          | Reserved, must be 0.
+	// 8-56       | UTF-8 coded frame number, or sample number for variable
+	//            | blocksize streams.
+	// 0/8/16     | Block size - 1, if the block size code was 0110 or 0111.
+	// 0/8/16     | Sample rate, if the sample rate code was 1100, 1101 or 1110.
+	// 8          | CRC-8 of everything before it, including the sync code.
+
+	if len(b) < 4 {
+		return fmt.Errorf("FATAL: frame header is %d byte(s), expected at least 4.", len(b))
+	}
+	if uint16(b[0])<<6|uint16(b[1])>>2 != FrameSyncCode {
+		return fmt.Errorf("FATAL: frame header does not start with the sync code.")
+	}
+	if b[1]&0x02 != 0 || b[3]&0x01 != 0 {
+		return fmt.Errorf("FATAL: reserved bits are set in the frame header.")
+	}
+	fh.VariableBlockSize = b[1]&0x01 == 1
+
+	bsCode, srCode := b[2]>>4, b[2]&0x0F
+	fh.ChannelAssignment = b[3] >> 4
+	switch {
+	case fh.ChannelAssignment < 8:
+		fh.Channels = fh.ChannelAssignment + 1
+	case fh.ChannelAssignment <= 10:
+		fh.Channels = 2
+	default:
+		return fmt.Errorf("FATAL: reserved channel assignment %d in frame header.", fh.ChannelAssignment)
+	}
+	ssCode := b[3] >> 1 & 0x07
+	if ssCode == 3 {
+		return fmt.Errorf("FATAL: reserved sample size code %d in frame header.", ssCode)
+	}
+	fh.BitsPerSample = frameSampleSizes[ssCode]
+
+	num, n, err := readCodedNumber(b[4:])
+	if err != nil {
+		return err
+	}
+	fh.Number = num
+	pos := 4 + n
+
+	// next returns the following n byte big-endian value of the header.
+	next := func(n int, name string) (uint32, error) {
+		if len(b) < pos+n {
+			return 0, fmt.Errorf("FATAL: frame header ends before its %s.", name)
+		}
+		var v uint32
+		for _, c := range b[pos : pos+n] {
+			v = v<<8 | uint32(c)
+		}
+		pos += n
+		return v, nil
+	}
+
+	switch {
+	case bsCode == 0:
+		return fmt.Errorf("FATAL: reserved block size code 0 in frame header.")
+	case bsCode == 1:
+		fh.BlockSize = 192
+	case bsCode <= 5:
+		fh.BlockSize = 576 << (bsCode - 2)
+	case bsCode == 6, bsCode == 7:
+		v, err := next(int(bsCode-5), "block size")
+		if err != nil {
+			return err
+		}
+		fh.BlockSize = v + 1
+	default:
+		fh.BlockSize = 256 << (bsCode - 8)
+	}
+
+	switch {
+	case srCode < 12:
+		fh.SampleRate = frameSampleRates[srCode]
+	case srCode == 12:
+		v, err := next(1, "sample rate")
+		if err != nil {
+			return err
+		}
+		fh.SampleRate = v * 1000
+	case srCode == 13, srCode == 14:
+		v, err := next(2, "sample rate")
+		if err != nil {
+			return err
+		}
+		fh.SampleRate = v
+		if srCode == 14 {
+			fh.SampleRate *= 10
+		}
+	default:
+		return fmt.Errorf("FATAL: invalid sample rate code %d in frame header.", srCode)
+	}
+
+	if len(b) <= pos {
+		return fmt.Errorf("FATAL: frame header ends before its CRC-8.")
+	}
+	fh.CRC8 = b[pos]
+	fh.Length = pos + 1
+	if sum := crc8(b[:pos]); sum != fh.CRC8 {
+		return fmt.Errorf("FATAL: frame header CRC-8 is 0x%02x, computed 0x%02x: %w", fh.CRC8, sum, ErrFrameHeaderCRC)
+	}
+	return nil
+}
+
+// FindFirstFrame returns the offset in data of the first audio frame, found
+// by searching for the frame sync code rather than by the metadata block
+// lengths, so that the audio of a file with corrupt metadata can still be
+// found. A sync code is taken as the first frame only if a valid frame
+// header, CRC-8 included, follows it and numbers the frame, or its first
+// sample, 0. ok is false if there is no such frame.
+func FindFirstFrame(data []byte) (offset int, ok bool) {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] != 0xFF || data[i+1]&0xFE != 0xF8 {
+			continue
+		}
+		fh := new(FrameHeader)
+		if fh.Parse(data[i:]) == nil && fh.Number == 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// CheckFrameSampleRates reads the audio frames from r, which must be at the
+// first frame as ParseMetadata leaves it, and checks that every frame header
+// coding a sample rate agrees with STREAMINFO. Frames are found by their sync
+// code; a candidate header is only taken as a frame if its CRC-8 is valid and
+// its frame or sample number follows on from the previous frame, so sync
+// codes within the audio data are skipped. A header numbered further on, as
+// after a lost frame, is taken once the header of the frame after it is
+// found. The error for the first frame that disagrees wraps
+// ErrSampleRateMismatch; finding no frame at all is an error too.
+func (meta *Metadata) CheckFrameSampleRates(r io.Reader) error {
+	sib := meta.Streaminfo.Data
+	if sib == nil {
+		return fmt.Errorf("FATAL: no STREAMINFO block to check the frames against.")
+	}
+
+	// A frame after a gap in the numbering, with the audio offset it was
+	// found at, waiting in pending, by the number of the frame after it, for
+	// that frame to be found.
+	type skipped struct {
+		fh     *FrameHeader
+		offset int64
+	}
+
+	br := bufio.NewReader(r)
+	var offset int64 // of the next byte of br, from the first frame
+	var frames int
+	var next uint64 // number the next frame header must have
+	pending := make(map[uint64]skipped)
+	check := func(fh *FrameHeader, offset int64) error {
+		if fh.SampleRate != 0 && fh.SampleRate != sib.SampleRate {
+			return fmt.Errorf("FATAL: frame %d at audio offset %d has a sample rate of %d Hz, STREAMINFO has %d Hz: %w", frames, offset, fh.SampleRate, sib.SampleRate, ErrSampleRateMismatch)
+		}
+		frames++
+		next = fh.next()
+		return nil
+	}
+	for {
+		b, err := br.Peek(FrameHeaderMaxLen)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(b) < 4 {
+			break
+		}
+
+		fh := new(FrameHeader)
+		if b[0] != 0xFF || b[1]&0xFE != 0xF8 || fh.Parse(b) != nil {
+			br.Discard(1)
+			offset++
+			continue
+		}
+		sk, resync := pending[fh.Number]
+		switch {
+		case fh.Number == next:
+		case resync:
+			if err := check(sk.fh, sk.offset); err != nil {
+				return err
+			}
+		case fh.Number > next:
+			if len(pending) == maxSkippedFrames {
+				pending = make(map[uint64]skipped)
+			}
+			pending[fh.next()] = skipped{fh, offset}
+			fallthrough
+		default:
+			br.Discard(1)
+			offset++
+			continue
+		}
+		if err := check(fh, offset); err != nil {
+			return err
+		}
+		pending = make(map[uint64]skipped)
+		br.Discard(fh.Length)
+		offset += int64(fh.Length)
+	}
+	if frames == 0 {
+		return fmt.Errorf("FATAL: no audio frames found to check.")
+	}
+	return nil
+}
+
+// maxSkippedFrames bounds the headers after a gap in the frame numbering
+// that CheckFrameSampleRates keeps while it looks for the frame after them.
+const maxSkippedFrames = 16
+
+// next returns the frame or sample number of the frame after fh.
+func (fh *FrameHeader) next() uint64 {
+	if fh.VariableBlockSize {
+		return fh.Number + uint64(fh.BlockSize)
+	}
+	return fh.Number + 1
+}
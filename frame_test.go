@@ -0,0 +1,127 @@
+package flac
+
+import (
+	"bytes"
+	"errors"
+	. "launchpad.net/gocheck"
+)
+
+func (s *S) TestParseFrameHeader(c *C) {
+	// The first frame header of the example stream in RFC 9639, followed by
+	// the start of its subframes.
+	b := []byte{0xff, 0xf8, 0x69, 0x18, 0x00, 0x00, 0xbf, 0x03, 0x58}
+	fh := new(FrameHeader)
+	c.Assert(fh.Parse(b), IsNil)
+	c.Check(fh, DeepEquals, &FrameHeader{
+		BlockSize:         1,
+		SampleRate:        44100,
+		ChannelAssignment: 1,
+		Channels:          2,
+		BitsPerSample:     16,
+		Number:            0,
+		CRC8:              0xbf,
+		Length:            7})
+}
+
+func (s *S) TestParseFrameHeaderVariable(c *C) {
+	// Variable blocksize, 4096 samples, 16 bit sample rate, mid/side, 24
+	// bits per sample and a 3 byte coded sample number.
+	b := []byte{0xff, 0xf9, 0xcd, 0xac, 0xe1, 0x88, 0xb4, 0xac, 0x44, 0xab}
+	fh := new(FrameHeader)
+	c.Assert(fh.Parse(b), IsNil)
+	c.Check(fh, DeepEquals, &FrameHeader{
+		VariableBlockSize: true,
+		BlockSize:         4096,
+		SampleRate:        44100,
+		ChannelAssignment: 10,
+		Channels:          2,
+		BitsPerSample:     24,
+		Number:            4660,
+		CRC8:              0xab,
+		Length:            10})
+}
+
+func (s *S) TestParseFrameHeaderErrors(c *C) {
+	b := []byte{0xff, 0xf8, 0x69, 0x18, 0x00, 0x00, 0xbe}
+	err := new(FrameHeader).Parse(b)
+	c.Check(err, ErrorMatches, "FATAL: frame header CRC-8 is 0xbe, computed 0xbf: .*")
+	c.Check(errors.Is(err, ErrFrameHeaderCRC), Equals, true)
+
+	for _, t := range []struct {
+		b   []byte
+		err string
+	}{
+		{[]byte{0xff, 0xf0, 0x69, 0x18, 0x00, 0x00, 0xbf}, ".*does not start with the sync code.*"},
+		{[]byte{0xff, 0xf8, 0x09, 0x18, 0x00, 0x00, 0xbf}, ".*reserved block size code 0.*"},
+		{[]byte{0xff, 0xf8, 0x6f, 0x18, 0x00, 0x00, 0xbf}, ".*invalid sample rate code 15.*"},
+		{[]byte{0xff, 0xf8, 0x69, 0xb8, 0x00, 0x00, 0xbf}, ".*reserved channel assignment 11.*"},
+		{[]byte{0xff, 0xf8, 0x69, 0x16, 0x00, 0x00, 0xbf}, ".*reserved sample size code 3.*"},
+		{[]byte{0xff, 0xf8, 0x69, 0x18, 0x80, 0x00, 0xbf}, ".*invalid coded number lead byte 0x80.*"},
+		{[]byte{0xff, 0xf8, 0x69, 0x18, 0x00, 0x00}, ".*ends before its CRC-8.*"},
+	} {
+		c.Check(new(FrameHeader).Parse(t.b), ErrorMatches, t.err, Commentf("header % x", t.b))
+	}
+}
+
+// mkFrameHeader returns a fixed blocksize frame header for frame number n,
+// which must be below 128, with 192 sample blocks and the given sample rate
+// code, followed by its CRC-8.
+func mkFrameHeader(n, srCode byte) []byte {
+	b := []byte{0xff, 0xf8, 0x10 | srCode, 0x18, n}
+	return append(b, crc8(b))
+}
+
+func (s *S) TestCheckFrameSampleRates(c *C) {
+	meta, err := ParseMetadata(bytes.NewReader(mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))))
+	c.Assert(err, IsNil)
+
+	// Frame data holding sync codes of its own, one of them followed by a
+	// valid header with the wrong frame number.
+	data := append([]byte{0xff, 0xf8, 0x00}, mkFrameHeader(7, 0x0a)...)
+	var audio []byte
+	for i := byte(0); i < 3; i++ {
+		audio = append(append(audio, mkFrameHeader(i, 0x09)...), data...)
+	}
+	audio = append(audio, mkFrameHeader(3, 0x00)...)
+	c.Check(meta.CheckFrameSampleRates(bytes.NewReader(audio)), IsNil)
+
+	audio = append(audio, data...)
+	audio = append(audio, mkFrameHeader(4, 0x0a)...)
+	err = meta.CheckFrameSampleRates(bytes.NewReader(audio))
+	c.Check(err, ErrorMatches, "FATAL: frame 4 at audio offset 60 has a sample rate of 48000 Hz, STREAMINFO has 44100 Hz: .*")
+	c.Check(errors.Is(err, ErrSampleRateMismatch), Equals, true)
+
+	c.Check(new(Metadata).CheckFrameSampleRates(bytes.NewReader(audio)), ErrorMatches, "FATAL: no STREAMINFO block.*")
+
+	// Frame 2 is lost: checking picks up again at frame 3, once frame 4
+	// follows it.
+	audio = nil
+	for _, i := range []byte{0, 1, 3, 4} {
+		audio = append(append(audio, mkFrameHeader(i, 0x09)...), data...)
+	}
+	c.Check(meta.CheckFrameSampleRates(bytes.NewReader(audio)), IsNil)
+	copy(audio[30:], mkFrameHeader(3, 0x0a))
+	c.Check(meta.CheckFrameSampleRates(bytes.NewReader(audio)), ErrorMatches, "FATAL: frame 2 at audio offset 30 has a sample rate of 48000 Hz, .*")
+
+	// Nothing that is a frame.
+	c.Check(meta.CheckFrameSampleRates(bytes.NewReader(nil)), ErrorMatches, "FATAL: no audio frames found to check.")
+	c.Check(meta.CheckFrameSampleRates(bytes.NewReader(data)), ErrorMatches, "FATAL: no audio frames found to check.")
+}
+
+func (s *S) TestFindFirstFrame(c *C) {
+	// Metadata holding a bare sync code and a valid header of a later
+	// frame, before the real first frame.
+	stream := mkStream(mkBlock(MetadataStreaminfo, true, mkStreaminfo()))
+	stream = append(stream, 0xff, 0xf8, 0x00)
+	stream = append(stream, mkFrameHeader(5, 0x09)...)
+	first := len(stream)
+	stream = append(stream, mkFrameHeader(0, 0x09)...)
+	stream = append(stream, mkFrameHeader(1, 0x09)...)
+
+	offset, ok := FindFirstFrame(stream)
+	c.Check(ok, Equals, true)
+	c.Check(offset, Equals, first)
+
+	_, ok = FindFirstFrame(stream[:first+3])
+	c.Check(ok, Equals, false)
+}
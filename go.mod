@@ -0,0 +1,5 @@
+module github.com/justinruggles/goflac-meta
+
+go 1.20
+
+require launchpad.net/gocheck v0.0.0-20140225173054-000000000087
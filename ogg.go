@@ -0,0 +1,193 @@
+// ogg.go - Reading FLAC metadata from an Ogg container.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package flac
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// OggSignature is the capture pattern that starts every Ogg page.
+	OggSignature = "OggS"
+
+	// oggPageHeaderLen is the length of an Ogg page header up to, but not
+	// including, its segment table.
+	oggPageHeaderLen = 27
+
+	// oggFLACHeaderLen is the length of the Ogg FLAC mapping header that
+	// precedes the "fLaC" signature in the first packet.
+	oggFLACHeaderLen = 9
+)
+
+// oggReader reads the packets of the first logical stream of an Ogg
+// bitstream. Pages of other, multiplexed, streams are skipped.
+type oggReader struct {
+	r      io.Reader
+	serial uint32
+	pages  int
+	segs   []byte // lacing values of the current page not yet read
+	data   []byte // data of the current page not yet read
+}
+
+// readPage reads the next page of the stream into or.segs and or.data.
+func (or *oggReader) readPage() error {
+	for {
+		h := make([]byte, oggPageHeaderLen)
+		if _, err := io.ReadFull(or.r, h); err != nil {
+			return fmt.Errorf("FATAL: error reading Ogg page header: %w: %w", ErrTruncatedFile, err)
+		}
+		if string(h[:4]) != OggSignature {
+			return fmt.Errorf("FATAL: '%s' is not a valid Ogg capture pattern: %w", string(h[:4]), ErrNotFLAC)
+		}
+		if h[4] != 0 {
+			return fmt.Errorf("FATAL: unsupported Ogg stream structure version %d.", h[4])
+		}
+		segs := make([]byte, h[26])
+		if _, err := io.ReadFull(or.r, segs); err != nil {
+			return fmt.Errorf("FATAL: error reading Ogg segment table: %w: %w", ErrTruncatedFile, err)
+		}
+		n := 0
+		for _, s := range segs {
+			n += int(s)
+		}
+		data := make([]byte, n)
+		if _, err := io.ReadFull(or.r, data); err != nil {
+			return fmt.Errorf("FATAL: Ogg page is %d byte(s) short: %w", n, ErrTruncatedBlock)
+		}
+
+		serial := binary.LittleEndian.Uint32(h[14:18])
+		if or.pages == 0 {
+			or.serial = serial
+		}
+		or.pages++
+		if serial == or.serial {
+			or.segs, or.data = segs, data
+			return nil
+		}
+	}
+}
+
+// errOggPacketTooLarge is returned by readPacket for a packet over its
+// limit.
+var errOggPacketTooLarge = errors.New("Ogg packet too large")
+
+// readPacket returns the next packet of the stream, joining the segments
+// of packets that span several pages. Once the packet is longer than max
+// bytes, it returns what it has read of it and errOggPacketTooLarge.
+func (or *oggReader) readPacket(max int) ([]byte, error) {
+	var packet []byte
+	for {
+		if len(or.segs) == 0 {
+			if err := or.readPage(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		n := int(or.segs[0])
+		packet = append(packet, or.data[:n]...)
+		or.segs, or.data = or.segs[1:], or.data[n:]
+		if len(packet) > max {
+			return packet, errOggPacketTooLarge
+		}
+		if n < 255 {
+			return packet, nil
+		}
+	}
+}
+
+// WalkOggMetadata is WalkMetadata for a FLAC stream in an Ogg container, as
+// in an .oga file. The first packet holds the Ogg FLAC mapping header, the
+// "fLaC" signature and the STREAMINFO block; every metadata block after it
+// is a packet of its own. Nothing past the page holding the last metadata
+// block is read.
+func WalkOggMetadata(r io.Reader, fn func(*MetadataBlockHeader, []byte) error) error {
+	return walkOggMetadata(r, -1, fn)
+}
+
+// walkOggMetadata is WalkOggMetadata with the limit of walkMetadata, which
+// counts the blocks as they would be in a native FLAC file. No packet is read
+// further than the longest block, or than the limit, allows.
+func walkOggMetadata(r io.Reader, limit int64, fn func(*MetadataBlockHeader, []byte) error) error {
+	// http://flac.sourceforge.net/ogg_mapping.html
+	// Field Len  | Data
+	// -----------+--------------------------------------------------------
+	// 8          | Packet type 0x7F.
+	// 4 * 8      | The ASCII signature "FLAC".
+	// 8          | Major version of the mapping, 1.
+	// 8          | Minor version of the mapping.
+	// 16         | Number of header packets after this one, or 0 if unknown.
+	// 4 * 8      | The native FLAC signature "fLaC".
+	// 34 * 8 + 32| The STREAMINFO block, with its header.
+
+	or := &oggReader{r: r}
+	size := int64(len(FlacSignature))
+	next := func(head int) ([]byte, error) {
+		max := int64(head + MetadataBlockHeaderLen/8 + MetadataBlockMaxLength)
+		over := limit >= 0 && int64(head)+limit-size < max
+		if over {
+			max = int64(head) + limit - size
+		}
+		packet, err := or.readPacket(int(max))
+		if err == errOggPacketTooLarge && over {
+			return nil, fmt.Errorf("FATAL: metadata of at least %d bytes is over the %d byte limit: %w", size+int64(len(packet)-head), limit, ErrMetadataTooLarge)
+		}
+		if err == errOggPacketTooLarge {
+			return nil, fmt.Errorf("FATAL: Ogg packet is longer than the largest metadata block: %w", ErrBlockTooLarge)
+		}
+		return packet, err
+	}
+
+	packet, err := next(oggFLACHeaderLen + len(FlacSignature))
+	if err != nil {
+		return err
+	}
+	if len(packet) < oggFLACHeaderLen+len(FlacSignature) ||
+		packet[0] != 0x7F || string(packet[1:5]) != "FLAC" ||
+		string(packet[oggFLACHeaderLen:oggFLACHeaderLen+len(FlacSignature)]) != FlacSignature {
+		return fmt.Errorf("FATAL: Ogg stream does not start with an Ogg FLAC header: %w", ErrNotFLAC)
+	}
+	if packet[5] != 1 {
+		return fmt.Errorf("FATAL: unsupported Ogg FLAC mapping version %d.%d.", packet[5], packet[6])
+	}
+	packet = packet[oggFLACHeaderLen+len(FlacSignature):]
+
+	for {
+		if len(packet) < MetadataBlockHeaderLen/8 {
+			return fmt.Errorf("FATAL: Ogg packet of %d byte(s) is too short for a metadata block header: %w", len(packet), ErrTruncatedFile)
+		}
+		mbh := new(MetadataBlockHeader)
+		if err := mbh.Parse(packet); err != nil {
+			return err
+		}
+		block := packet[MetadataBlockHeaderLen/8:]
+		if len(block) != int(mbh.Length) {
+			return fmt.Errorf("FATAL: %s metadata block is %d byte(s), but its Ogg packet holds %d: %w", mbh.Type, mbh.Length, len(block), ErrTruncatedBlock)
+		}
+
+		if err := fn(mbh, block); err != nil {
+			return err
+		}
+		if mbh.Last {
+			return nil
+		}
+		size += int64(len(packet))
+
+		if packet, err = next(0); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package flac
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	. "launchpad.net/gocheck"
+)
+
+// mkOggPage returns an Ogg page of the given stream holding data, which is
+// split into packets at each of the lengths in packets. A final length of
+// -1 leaves the last packet unfinished, to be continued on the next page.
+func mkOggPage(serial uint32, data []byte, packets ...int) []byte {
+	var segs []byte
+	left := len(data)
+	for _, n := range packets {
+		if n < 0 {
+			for ; left > 0; left -= 255 {
+				segs = append(segs, 255)
+			}
+			break
+		}
+		left -= n
+		for ; n >= 255; n -= 255 {
+			segs = append(segs, 255)
+		}
+		segs = append(segs, byte(n))
+	}
+	h := make([]byte, oggPageHeaderLen)
+	copy(h, OggSignature)
+	binary.LittleEndian.PutUint32(h[14:], serial)
+	h[26] = byte(len(segs))
+	return append(append(h, segs...), data...)
+}
+
+// mkOggFLACHeader returns the first packet of an Ogg FLAC stream.
+func mkOggFLACHeader(packets uint16) []byte {
+	b := []byte{0x7f, 'F', 'L', 'A', 'C', 1, 0, byte(packets >> 8), byte(packets)}
+	b = append(b, FlacSignature...)
+	return append(b, mkBlock(MetadataStreaminfo, false, mkStreaminfo())...)
+}
+
+func (s *S) TestReadOggFLAC(c *C) {
+	first := mkOggFLACHeader(2)
+	vc := (&VorbisCommentBlock{Vendor: "ogg", TotalComments: 1, Comments: []string{"TITLE=oga"}}).Encode()
+	second := mkBlock(MetadataVorbisComment, false, vc)
+	third := mkBlock(MetadataPadding, true, make([]byte, 300))
+
+	var stream []byte
+	stream = append(stream, mkOggPage(7, first, len(first))...)
+	stream = append(stream, mkOggPage(9, []byte("other stream"), 12)...)
+	stream = append(stream, mkOggPage(7, append(second, third[:255]...), len(second), -1)...)
+	stream = append(stream, mkOggPage(7, third[255:], len(third)-255)...)
+	audio := mkOggPage(7, []byte{0xff, 0xf8}, 2)
+	r := bytes.NewReader(append(stream, audio...))
+
+	meta, err := ParseMetadata(r)
+	c.Assert(err, IsNil)
+	c.Check(meta.Streaminfo.Data.SampleRate, Equals, uint32(44100))
+	c.Check(meta.VorbisComment.Data.Comments, DeepEquals, []string{"TITLE=oga"})
+	c.Check(meta.Padding.Data.Length, Equals, uint32(300))
+	c.Check(meta.Blocks, HasLen, 3)
+	c.Check(r.Len(), Equals, len(audio))
+
+	// Block offsets are native FLAC ones, so nothing locates the audio.
+	c.Check(meta.Ogg, Equals, true)
+	_, ok := meta.AudioOffset()
+	c.Check(ok, Equals, false)
+	_, err = meta.AudioReader(r)
+	c.Check(err, ErrorMatches, "FATAL: the audio of an Ogg FLAC file is not at a single offset.*")
+	_, ok = meta.AverageBitrate(1 << 20)
+	c.Check(ok, Equals, false)
+}
+
+func (s *S) TestReadOggNotFLAC(c *C) {
+	vorbis := []byte("\x01vorbis and the rest")
+	_, err := ParseMetadata(bytes.NewReader(mkOggPage(1, vorbis, len(vorbis))))
+	c.Check(err, ErrorMatches, "FATAL: Ogg stream does not start with an Ogg FLAC header: .*")
+}
+
+// repeatReader repeats data endlessly.
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (rr *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, rr.data[rr.off:])
+	rr.off = (rr.off + n) % len(rr.data)
+	return n, nil
+}
+
+func (s *S) TestReadOggPacketTooLarge(c *C) {
+	// A packet that never ends, continued on page after page.
+	first := mkOggFLACHeader(1)
+	start := mkOggPage(7, first, len(first))
+	endless := mkOggPage(7, make([]byte, 255*255), -1)
+	r := func() io.Reader { return io.MultiReader(bytes.NewReader(start), &repeatReader{data: endless}) }
+
+	meta := &Metadata{MaxMetadataBytes: 100000}
+	err := meta.Read(r())
+	c.Check(errors.Is(err, ErrMetadataTooLarge), Equals, true)
+	c.Check(err, ErrorMatches, "FATAL: metadata of at least 100002 bytes is over the 100000 byte limit: .*")
+
+	meta = &Metadata{MaxMetadataBytes: -1}
+	err = meta.Read(r())
+	c.Check(errors.Is(err, ErrBlockTooLarge), Equals, true)
+}
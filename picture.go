@@ -0,0 +1,198 @@
+// picture.go - Validation and replacement of embedded FLAC pictures.
+// Copyright (C) 2012 Matthew White <mtw@vne.net>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or (at
+// your option) any later version.
+//
+// This program is distributed in the hope that it will be useful, but
+// WITHOUT ANY WARRANTY; without even the implied warranty of MERCHANTABILITY
+// or FITNESS FOR A PARTICULAR PURPOSE. See the GNU General Public License
+// for more details.
+
+package flac
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+// pictureFormats maps the format names registered with the image package to
+// the MIME types a PICTURE block may declare for them.
+var pictureFormats = map[string][]string{
+	"jpeg": {"image/jpeg", "image/jpg"},
+	"png":  {"image/png"},
+	"gif":  {"image/gif"},
+}
+
+// ValidateImage decodes the header of PictureBlob and checks that the
+// declared MIME type, width and height agree with the image itself. It is
+// not called by Parse. A picture whose MIME type is "-->" holds a URL rather
+// than image data and is not checked.
+func (pb *PictureBlock) ValidateImage() error {
+	if pb.MimeType == "-->" {
+		return nil
+	}
+
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(pb.PictureBlob))
+	if err != nil {
+		return fmt.Errorf("FATAL: unable to decode picture data: %s", err)
+	}
+
+	mime := strings.ToLower(pb.MimeType)
+	match := false
+	for _, m := range pictureFormats[format] {
+		if mime == m {
+			match = true
+		}
+	}
+	if !match {
+		return fmt.Errorf("FATAL: picture MIME type '%s' does not match %s image data.", pb.MimeType, format)
+	}
+
+	if pb.Width != uint32(cfg.Width) || pb.Height != uint32(cfg.Height) {
+		return fmt.Errorf("FATAL: picture is declared %dx%d but the image is %dx%d.", pb.Width, pb.Height, cfg.Width, cfg.Height)
+	}
+	return nil
+}
+
+// colorDepth returns the bits per pixel of the image data, of the format
+// image.DecodeConfig named and color model m, and, for a palette, its number
+// of colors, as a PICTURE block records them. As in metaflac, the depth is
+// read from the PNG IHDR chunk or the JPEG frame header rather than from the
+// model Go would decode the image to, so an RGB PNG counts as 24 bits, not
+// 32, and a palette counts as 24 bits whatever the size of its indexes.
+func colorDepth(format string, data []byte, m color.Model) (depth, colors uint32) {
+	if p, ok := m.(color.Palette); ok {
+		return 24, uint32(len(p))
+	}
+	switch format {
+	case "png":
+		// The IHDR chunk comes first, after the 8 byte signature, and
+		// holds the bit depth and color type after the chunk length and
+		// type and the width and height.
+		if len(data) >= 26 {
+			return uint32(data[24]) * pngChannels[data[25]], 0
+		}
+	case "jpeg":
+		return jpegDepth(data), 0
+	}
+	return 0, 0
+}
+
+// pngChannels maps a PNG color type, other than a palette, to its number of
+// samples per pixel.
+var pngChannels = map[byte]uint32{0: 1, 2: 3, 4: 2, 6: 4}
+
+// jpegDepth returns the sample precision times the number of components in
+// the frame header of the JPEG data, or 0 if it has none.
+func jpegDepth(data []byte) uint32 {
+	// Every segment after the SOI marker starts with 0xFF, a marker byte
+	// and, except for the RSTn and TEM markers, a 16 bit length.
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return 0
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			i++
+			continue
+		}
+		if marker == 0x01 || marker >= 0xD0 && marker <= 0xD7 {
+			i += 2
+			continue
+		}
+		// SOF0 to SOF15, all but DHT, JPG and DAC, are frame headers:
+		// precision, height, width and number of components.
+		if marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC {
+			if i+10 > len(data) {
+				return 0
+			}
+			return uint32(data[i+4]) * uint32(data[i+9])
+		}
+		i += 2 + (int(data[i+2])<<8 | int(data[i+3]))
+	}
+	return 0
+}
+
+// SetPicture replaces every picture of type pictureType with one of the
+// image data, of MIME type mime. Its width, height and color depth are read
+// from the image header, and data that does not decode as an image of the
+// MIME type is rejected, unless mime is "-->" and data is a URL. The new
+// block takes the place of the first picture replaced, or else goes last,
+// before any final PADDING block. Block offsets and the last-block flag are
+// updated.
+func (meta *Metadata) SetPicture(pictureType uint32, mime string, data []byte) error {
+	if pictureType > PicturePublisherLogotype {
+		return fmt.Errorf("FATAL: invalid picture type: %d.", pictureType)
+	}
+	pb := &PictureBlock{
+		PictureTypeId: pictureType,
+		PictureType:   LookupPictureType(pictureType),
+		MimeType:      mime,
+		Length:        uint32(len(data)),
+		PictureBlob:   data,
+	}
+	if mime != "-->" {
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("FATAL: unable to decode picture data: %s", err)
+		}
+		pb.Width, pb.Height = uint32(cfg.Width), uint32(cfg.Height)
+		pb.ColorDepth, pb.NumColors = colorDepth(format, data, cfg.ColorModel)
+		if err := pb.ValidateImage(); err != nil {
+			return err
+		}
+		// The format requires the 32x32 file icon to be a PNG.
+		if pictureType == PictureFileIcon && (strings.ToLower(mime) != "image/png" || cfg.Width != 32 || cfg.Height != 32) {
+			return fmt.Errorf("FATAL: a %s picture must be a 32x32 PNG image.", pb.PictureType)
+		}
+	}
+	body := pb.encode()
+	if len(body) > MetadataBlockMaxLength {
+		return fmt.Errorf("FATAL: %s block of %d bytes does not fit in a metadata block: %w", MetadataPicture, len(body), ErrBlockTooLarge)
+	}
+	pic := &Picture{&MetadataBlockHeader{Type: MetadataPicture, Length: uint32(len(body))}, pb, true}
+
+	pictures := map[*MetadataBlockHeader]*Picture{pic.Header: pic}
+	for _, p := range meta.Pictures {
+		if p.Data.PictureTypeId != pictureType {
+			pictures[p.Header] = p
+		}
+	}
+	at := -1
+	blocks := make([]*Block, 0, len(meta.Blocks)+1)
+	for _, b := range meta.Blocks {
+		if b.Header.Type == MetadataPicture && pictures[b.Header] == nil {
+			if at < 0 {
+				at = len(blocks)
+			}
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	if at < 0 {
+		at = len(blocks)
+		if at > 1 && blocks[at-1].Header.Type == MetadataPadding {
+			at--
+		}
+	}
+	blocks = append(blocks[:at], append([]*Block{{Header: pic.Header}}, blocks[at:]...)...)
+
+	meta.Pictures = nil
+	for _, b := range blocks {
+		if p := pictures[b.Header]; p != nil {
+			meta.Pictures = append(meta.Pictures, p)
+		}
+	}
+	meta.Blocks = blocks
+	meta.relink()
+	return nil
+}
@@ -0,0 +1,126 @@
+package flac
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	. "launchpad.net/gocheck"
+)
+
+// mkPNG returns a w x h PNG image.
+func mkPNG(c *C, w, h int) []byte {
+	var buf bytes.Buffer
+	c.Assert(png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))), IsNil)
+	return buf.Bytes()
+}
+
+func (s *S) TestPictureValidateImage(c *C) {
+	img := mkPNG(c, 3, 2)
+	pb := &PictureBlock{MimeType: "image/png", Width: 3, Height: 2, PictureBlob: img}
+	c.Check(pb.ValidateImage(), IsNil)
+
+	pb.MimeType = "image/jpeg"
+	c.Check(pb.ValidateImage(), ErrorMatches, "FATAL: picture MIME type 'image/jpeg' does not match png image data.")
+
+	pb.MimeType, pb.Height = "image/PNG", 3
+	c.Check(pb.ValidateImage(), ErrorMatches, "FATAL: picture is declared 3x3 but the image is 3x2.")
+
+	pb.PictureBlob = []byte("not an image")
+	c.Check(pb.ValidateImage(), ErrorMatches, "FATAL: unable to decode picture data: .*")
+
+	pb = &PictureBlock{MimeType: "-->", PictureBlob: []byte("http://example.com/cover.jpg")}
+	c.Check(pb.ValidateImage(), IsNil)
+}
+
+func (s *S) TestLookupPictureType(c *C) {
+	c.Check(LookupPictureType(PictureOther), Equals, "Other")
+	c.Check(LookupPictureType(PictureFileIcon), Equals, "File Icon")
+	c.Check(LookupPictureType(PictureCoverFront), Equals, "Cover (front)")
+	c.Check(LookupPictureType(PicturePublisherLogotype), Equals, "Publisher/Studio Logotype")
+	c.Check(PicturePublisherLogotype, Equals, 20)
+	c.Check(LookupPictureType(21), Equals, "UNKNOWN")
+}
+
+func (s *S) TestMetadataSetPicture(c *C) {
+	stream := mkStream(
+		mkBlock(MetadataStreaminfo, false, mkStreaminfo()),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverBack, "image/jpeg", "back", []byte("jpeg"))),
+		mkBlock(MetadataPicture, false, mkPicture(PictureCoverFront, "image/jpeg", "old", []byte("jpeg"))),
+		mkBlock(MetadataPadding, true, make([]byte, 10)))
+	meta, err := ParseMetadata(bytes.NewReader(stream))
+	c.Assert(err, IsNil)
+
+	img := mkPNG(c, 3, 2)
+	c.Assert(meta.SetPicture(PictureCoverFront, "image/png", img), IsNil)
+	c.Check(meta.BlockTypes(), DeepEquals, []string{"STREAMINFO", "PICTURE", "PICTURE", "PADDING"})
+	c.Assert(meta.Pictures, HasLen, 2)
+	c.Check(meta.Pictures[0].Data.PictureTypeId, Equals, uint32(PictureCoverBack))
+	c.Check(meta.Pictures[1].Data, DeepEquals, &PictureBlock{
+		PictureTypeId: PictureCoverFront,
+		PictureType:   "Cover (front)",
+		MimeType:      "image/png",
+		Width:         3,
+		Height:        2,
+		ColorDepth:    8,
+		Length:        uint32(len(img)),
+		PictureBlob:   img,
+	})
+	c.Check(meta.Blocks[3].Header.Last, Equals, true)
+	c.Check(meta.MetadataLength(), Equals, meta.Blocks[3].Offset+meta.Blocks[3].Len())
+
+	var out bytes.Buffer
+	_, err = meta.WriteTo(&out)
+	c.Assert(err, IsNil)
+	got, err := ParseMetadata(&out)
+	c.Assert(err, IsNil)
+	c.Check(got.Pictures[1].Data, DeepEquals, meta.Pictures[1].Data)
+
+	// A new type goes before the final PADDING block.
+	c.Assert(meta.SetPicture(PictureArtist, "-->", []byte("http://example.com/a.png")), IsNil)
+	c.Check(meta.BlockTypes(), DeepEquals, []string{"STREAMINFO", "PICTURE", "PICTURE", "PICTURE", "PADDING"})
+	c.Check(meta.Pictures[2].Data.MimeType, Equals, "-->")
+
+	c.Check(meta.SetPicture(PictureCoverFront, "image/png", []byte("not an image")), ErrorMatches, "FATAL: unable to decode picture data: .*")
+	c.Check(meta.SetPicture(PictureCoverFront, "image/jpeg", img), ErrorMatches, "FATAL: picture MIME type 'image/jpeg' does not match png image data.")
+	c.Check(meta.SetPicture(PictureFileIcon, "image/png", img), ErrorMatches, "FATAL: a File Icon picture must be a 32x32 PNG image.")
+	c.Check(meta.SetPicture(21, "image/png", img), ErrorMatches, "FATAL: invalid picture type: 21.")
+	c.Check(meta.Pictures, HasLen, 3)
+}
+
+func (s *S) TestPictureColorDepth(c *C) {
+	rect := image.Rect(0, 0, 4, 4)
+	rgba := image.NewRGBA(rect)
+	for i := 3; i < len(rgba.Pix); i += 4 {
+		rgba.Pix[i] = 0xff
+	}
+	alpha := image.NewNRGBA(rect)
+	alpha.Set(1, 1, color.NRGBA{1, 2, 3, 4})
+
+	for _, t := range []struct {
+		name          string
+		encode        func(*bytes.Buffer) error
+		depth, colors uint32
+	}{
+		{"gray PNG", func(b *bytes.Buffer) error { return png.Encode(b, image.NewGray(rect)) }, 8, 0},
+		{"16 bit gray PNG", func(b *bytes.Buffer) error { return png.Encode(b, image.NewGray16(rect)) }, 16, 0},
+		{"RGB PNG", func(b *bytes.Buffer) error { return png.Encode(b, rgba) }, 24, 0},
+		{"RGBA PNG", func(b *bytes.Buffer) error { return png.Encode(b, alpha) }, 32, 0},
+		{"palette PNG", func(b *bytes.Buffer) error { return png.Encode(b, image.NewPaletted(rect, palette.Plan9[:16])) }, 24, 16},
+		{"color JPEG", func(b *bytes.Buffer) error { return jpeg.Encode(b, rgba, nil) }, 24, 0},
+		{"gray JPEG", func(b *bytes.Buffer) error { return jpeg.Encode(b, image.NewGray(rect), nil) }, 8, 0},
+		{"GIF", func(b *bytes.Buffer) error { return gif.Encode(b, image.NewPaletted(rect, palette.Plan9), nil) }, 24, 256},
+	} {
+		var buf bytes.Buffer
+		c.Assert(t.encode(&buf), IsNil)
+		cfg, format, err := image.DecodeConfig(bytes.NewReader(buf.Bytes()))
+		c.Assert(err, IsNil)
+		depth, colors := colorDepth(format, buf.Bytes(), cfg.ColorModel)
+		c.Check(depth, Equals, t.depth, Commentf("%s", t.name))
+		c.Check(colors, Equals, t.colors, Commentf("%s", t.name))
+	}
+	c.Check(jpegDepth([]byte{0xff, 0xd8, 0xff, 0xe0, 0x00}), Equals, uint32(0))
+}